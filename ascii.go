@@ -0,0 +1,85 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import "io"
+
+// asciiEncoder converts the line endings of the data read from r to the
+// CRLF used on the wire in TYPE A. Existing CRLF pairs are kept unchanged.
+type asciiEncoder struct {
+	r       io.Reader
+	buf     []byte
+	pending []byte
+	lastCR  bool
+}
+
+func newASCIIEncoder(r io.Reader) io.Reader {
+	return &asciiEncoder{r: r, buf: make([]byte, 32*1024)}
+}
+
+func (e *asciiEncoder) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		n, err := e.r.Read(e.buf)
+		e.pending = e.pending[:0]
+		for _, b := range e.buf[:n] {
+			if b == '\n' && !e.lastCR {
+				e.pending = append(e.pending, '\r')
+			}
+			e.pending = append(e.pending, b)
+			e.lastCR = b == '\r'
+		}
+		if err != nil {
+			if len(e.pending) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// asciiDecoder converts the CRLF line endings of the TYPE A data read from
+// r to LF. A CR that is not followed by LF is kept.
+type asciiDecoder struct {
+	r         io.Reader
+	buf       []byte
+	pending   []byte
+	pendingCR bool
+}
+
+func newASCIIDecoder(r io.Reader) io.Reader {
+	return &asciiDecoder{r: r, buf: make([]byte, 32*1024)}
+}
+
+func (d *asciiDecoder) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		n, err := d.r.Read(d.buf)
+		d.pending = d.pending[:0]
+		for _, b := range d.buf[:n] {
+			if d.pendingCR && b != '\n' {
+				d.pending = append(d.pending, '\r')
+			}
+			d.pendingCR = b == '\r'
+			if !d.pendingCR {
+				d.pending = append(d.pending, b)
+			}
+		}
+		if err != nil {
+			if d.pendingCR {
+				d.pending = append(d.pending, '\r')
+				d.pendingCR = false
+			}
+			if len(d.pending) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
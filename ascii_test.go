@@ -0,0 +1,54 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestASCIIConversion(t *testing.T) {
+	var asciiTests = []struct {
+		lf   string // local representation
+		crlf string // TYPE A representation
+	}{
+		{"", ""},
+		{"a\nb\n", "a\r\nb\r\n"},
+		{"\n\n", "\r\n\r\n"},
+		{"no newline", "no newline"},
+		{"lone\rcr\n", "lone\rcr\r\n"},
+		{"trailing cr\r", "trailing cr\r"},
+	}
+
+	readAll := func(r io.Reader) string {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	for _, tt := range asciiTests {
+		for _, oneByte := range []bool{false, true} {
+			wrap := func(r io.Reader) io.Reader { return r }
+			if oneByte {
+				wrap = iotest.OneByteReader
+			}
+			if s := readAll(wrap(newASCIIEncoder(wrap(strings.NewReader(tt.lf))))); s != tt.crlf {
+				t.Errorf("encode %q: got %q, want %q", tt.lf, s, tt.crlf)
+			}
+			if s := readAll(wrap(newASCIIDecoder(wrap(strings.NewReader(tt.crlf))))); s != tt.lf {
+				t.Errorf("decode %q: got %q, want %q", tt.crlf, s, tt.lf)
+			}
+		}
+	}
+
+	// CRLF already in a local file is sent unchanged
+	if s := readAll(newASCIIEncoder(strings.NewReader("dos\r\n"))); s != "dos\r\n" {
+		t.Errorf("encode CRLF: got %q", s)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capableDriver adds the optional interfaces MemDriver lacks.
+type capableDriver struct {
+	*MemDriver
+	links     map[string]string
+	allocated []string
+}
+
+func (d *capableDriver) Symlink(target, name string) error {
+	d.links[name] = target
+	return nil
+}
+
+func (d *capableDriver) Readlink(name string) (string, error) {
+	target, ok := d.links[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return target, nil
+}
+
+func (d *capableDriver) Allocate(name string, size int64) error {
+	d.allocated = append(d.allocated, name)
+	return nil
+}
+
+func (d *capableDriver) StatFS(name string) (int64, error) {
+	return 1000, nil
+}
+
+func TestCapabilities(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	driver := &capableDriver{MemDriver: memDriver, links: map[string]string{}}
+	c, replies := newTestConn(driver)
+	defer c.Close()
+
+	send := func(line string) string {
+		done := sendCommand(c, line+"\r\n")
+		reply := readMultiline(t, replies)
+		<-done
+		return reply
+	}
+	if feats := send("FEAT"); !strings.Contains(feats, "\n AVBL\n") {
+		t.Errorf("AVBL not advertised: %q", feats)
+	}
+
+	send("ALLO 5")
+	client, server := net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done := sendCommand(c, "STOR a.txt\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	client.Write([]byte("hello"))
+	client.Close()
+	expectReply(t, replies, "226")
+	if strings.Join(driver.allocated, " ") != "/a.txt" {
+		t.Errorf("unexpected allocations %v", driver.allocated)
+	}
+
+	var capabilityTests = []struct {
+		line  string
+		reply string
+	}{
+		{"AVBL", "213 1000"},
+		{"ALLO", "501"},
+		{"SITE SYMLINK a.txt link", "200"},
+		{"SITE READLINK link", "200 a.txt"},
+		{"SITE READLINK a.txt", "550"},
+		{"SITE CPTO b.txt", "503"},
+		{"SITE CPFR missing", "550"},
+		{"SITE CPFR a.txt", "350"},
+		{"NOOP", "200"},
+		{"SITE CPTO b.txt", "503"},
+		{"SITE CPFR a.txt", "350"},
+		{"SITE CPTO b.txt", "250"},
+		{"SITE CPTO c.txt", "503"},
+	}
+	for _, tt := range capabilityTests {
+		if reply := send(tt.line); !strings.HasPrefix(reply, tt.reply) {
+			t.Errorf("%s: expected reply %q, got %q", tt.line, tt.reply, reply)
+		}
+	}
+	if got := readMemFile(t, memDriver, "/b.txt", 0); got != "hello" {
+		t.Errorf("got %q in the copy", got)
+	}
+}
+
+func TestAllocateAtomicUploads(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	driver := &capableDriver{MemDriver: memDriver, links: map[string]string{}}
+	c, replies := newTestConn(driver)
+	defer c.Close()
+	c.user = ""
+	c.server = NewServer(&ServerOpts{
+		Logger:        &DiscardLogger{},
+		Auth:          &SimpleAuth{Name: "alice", Password: "secret"},
+		AtomicUploads: true,
+	})
+
+	for _, line := range []string{"USER alice", "PASS secret"} {
+		done := sendCommand(c, line+"\r\n")
+		readMultiline(t, replies)
+		<-done
+	}
+	// only the append is written in place
+	for _, command := range []string{"STOR", "APPE"} {
+		done := sendCommand(c, "ALLO 5\r\n")
+		expectReply(t, replies, "200")
+		<-done
+		client, server := net.Pipe()
+		c.dataConn = pipeSocket{server}
+		done = sendCommand(c, command+" a.txt\r\n")
+		expectReply(t, replies, "150")
+		<-done
+		client.Write([]byte("hello"))
+		client.Close()
+		expectReply(t, replies, "226")
+	}
+	if strings.Join(driver.allocated, " ") != "/a.txt" {
+		t.Errorf("unexpected allocations %v", driver.allocated)
+	}
+}
+
+// creationDriver keeps the creation times MemDriver ignores.
+type creationDriver struct {
+	*MemDriver
+	created map[string]time.Time
+}
+
+func (d creationDriver) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	d.created[name] = ctime
+	return nil
+}
+
+func (d creationDriver) CreationTimeSupported() bool {
+	return true
+}
+
+func TestCreationTime(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	if _, err := memDriver.PutFile("/a.txt", strings.NewReader("a"), false); err != nil {
+		t.Fatal(err)
+	}
+	created := map[string]time.Time{}
+	for _, driver := range []Driver{memDriver, creationDriver{memDriver, created}} {
+		_, supported := driver.(CreationTimeDriver)
+		c, replies := newTestConn(driver)
+		send := func(line string) string {
+			done := sendCommand(c, line+"\r\n")
+			reply := readMultiline(t, replies)
+			<-done
+			return reply
+		}
+
+		if feats := send("FEAT"); strings.Contains(feats, "MFCT") != supported {
+			t.Errorf("MFCT advertised %v: %q", !supported, feats)
+		}
+		expected := "502"
+		if supported {
+			expected = "213 Create=20180102030405; a.txt"
+		}
+		if reply := send("MFCT 20180102030405 a.txt"); !strings.HasPrefix(reply, expected) {
+			t.Errorf("MFCT: expected reply %q, got %q", expected, reply)
+		}
+		if reply := send("SITE UTIME a.txt 20180102030405 20180102030405 20180102030405 UTC"); !strings.HasPrefix(reply, "200") {
+			t.Errorf("SITE UTIME: got %q", reply)
+		}
+		c.Close()
+	}
+	if ctime := created["/a.txt"]; !ctime.Equal(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("creation time not set, got %v", ctime)
+	}
+}
+
+func TestCapabilitiesMissing(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	c, replies := newTestConn(struct{ Driver }{memDriver})
+	defer c.Close()
+
+	var missingTests = []struct {
+		line  string
+		reply string
+	}{
+		{"ALLO 100", "202"},
+		{"AVBL", "550"},
+		{"SITE SYMLINK a b", "502"},
+		{"SITE CPFR a", "502"},
+	}
+	for _, tt := range missingTests {
+		done := sendCommand(c, tt.line+"\r\n")
+		expectReply(t, replies, tt.reply)
+		<-done
+	}
+	done := sendCommand(c, "FEAT\r\n")
+	if feats := readMultiline(t, replies); strings.Contains(feats, "AVBL") {
+		t.Errorf("AVBL advertised: %q", feats)
+	}
+	<-done
+}
+
+func TestResumeUploadTruncate(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	if _, err := memDriver.PutFile("/file", strings.NewReader("0123"), false); err != nil {
+		t.Fatal(err)
+	}
+	// truncates then appends, without RestartDriver
+	c, replies := newTestConn(struct {
+		Driver
+		TruncateDriver
+	}{memDriver, memDriver})
+	defer c.Close()
+
+	done := sendCommand(c, "REST 2\r\n")
+	expectReply(t, replies, "350")
+	<-done
+	client, server := net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "STOR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	client.Write([]byte("ab"))
+	client.Close()
+	expectReply(t, replies, "226")
+	if got := readMemFile(t, memDriver, "/file", 0); got != "01ab" {
+		t.Errorf("got %q after resuming", got)
+	}
+}
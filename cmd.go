@@ -5,17 +5,37 @@
 package server
 
 import (
+	"compress/zlib"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Command is the implementation of an FTP command. The built-in commands
+// can be overridden and new ones added with Server.RegisterCommand.
 type Command interface {
+	// IsExtend returns true if the command is an extension that should be
+	// listed in the FEAT reply
 	IsExtend() bool
+
+	// RequireParam returns true if the command must not be called without
+	// a parameter
 	RequireParam() bool
+
+	// RequireAuth returns true if the user must be logged in to call the
+	// command
 	RequireAuth() bool
+
+	// Execute runs the command with the given parameter and replies to the
+	// client
 	Execute(*Conn, string)
 }
 
@@ -23,58 +43,108 @@ type commandMap map[string]Command
 
 var (
 	commands = commandMap{
-		"ADAT": commandAdat{},
-		"ALLO": commandAllo{},
-		"APPE": commandAppe{},
-		"AUTH": commandAuth{},
-		"CDUP": commandCdup{},
-		"CWD":  commandCwd{},
-		"CCC":  commandCcc{},
-		"CONF": commandConf{},
-		"DELE": commandDele{},
-		"ENC":  commandEnc{},
-		"EPRT": commandEprt{},
-		"EPSV": commandEpsv{},
-		"FEAT": commandFeat{},
-		"LIST": commandList{},
-		"LPRT": commandLprt{},
-		"NLST": commandNlst{},
-		"MDTM": commandMdtm{},
-		"MIC":  commandMic{},
-		"MKD":  commandMkd{},
-		"MODE": commandMode{},
-		"NOOP": commandNoop{},
-		"OPTS": commandOpts{},
-		"PASS": commandPass{},
-		"PASV": commandPasv{},
-		"PBSZ": commandPbsz{},
-		"PORT": commandPort{},
-		"PROT": commandProt{},
-		"PWD":  commandPwd{},
-		"QUIT": commandQuit{},
-		"RETR": commandRetr{},
-		"REST": commandRest{},
-		"RNFR": commandRnfr{},
-		"RNTO": commandRnto{},
-		"RMD":  commandRmd{},
-		"SIZE": commandSize{},
-		"STOR": commandStor{},
-		"STRU": commandStru{},
-		"SYST": commandSyst{},
-		"TYPE": commandType{},
-		"USER": commandUser{},
-		"XCUP": commandCdup{},
-		"XCWD": commandCwd{},
-		"XMKD": commandMkd{},
-		"XPWD": commandPwd{},
-		"XRMD": commandRmd{},
+		"ABOR":    commandAbor{},
+		"ADAT":    commandAdat{},
+		"ALLO":    commandAllo{},
+		"APPE":    commandAppe{},
+		"AUTH":    commandAuth{},
+		"AVBL":    commandAvbl{},
+		"CDUP":    commandCdup{},
+		"CWD":     commandCwd{},
+		"CCC":     commandCcc{},
+		"CONF":    commandConf{},
+		"DELE":    commandDele{},
+		"ENC":     commandEnc{},
+		"EPRT":    commandEprt{},
+		"EPSV":    commandEpsv{},
+		"FEAT":    commandFeat{},
+		"HASH":    commandHash{},
+		"HELP":    commandHelp{},
+		"LIST":    commandList{},
+		"LPRT":    commandLprt{},
+		"NLST":    commandNlst{},
+		"MDTM":    commandMdtm{},
+		"MFCT":    commandMfct{},
+		"MFMT":    commandMfmt{},
+		"MIC":     commandMic{},
+		"MKD":     commandMkd{},
+		"MLSD":    commandMlsd{},
+		"MLST":    commandMlst{},
+		"MODE":    commandMode{},
+		"NOOP":    commandNoop{},
+		"OPTS":    commandOpts{},
+		"PASS":    commandPass{},
+		"PASV":    commandPasv{},
+		"PBSZ":    commandPbsz{},
+		"PORT":    commandPort{},
+		"PROT":    commandProt{},
+		"PWD":     commandPwd{},
+		"QUIT":    commandQuit{},
+		"RANG":    commandRang{},
+		"RETR":    commandRetr{},
+		"REST":    commandRest{},
+		"RNFR":    commandRnfr{},
+		"RNTO":    commandRnto{},
+		"RMD":     commandRmd{},
+		"SITE":    commandSite{},
+		"SIZE":    commandSize{},
+		"STAT":    commandStat{},
+		"STOR":    commandStor{},
+		"STRU":    commandStru{},
+		"SYST":    commandSyst{},
+		"TYPE":    commandType{},
+		"USER":    commandUser{},
+		"XCRC":    commandXHash{HashCRC32},
+		"XCUP":    commandCdup{},
+		"XCWD":    commandCwd{},
+		"XMD5":    commandXHash{HashMD5},
+		"XMKD":    commandMkd{},
+		"XPWD":    commandPwd{},
+		"XRMD":    commandRmd{},
+		"XSHA1":   commandXHash{HashSHA1},
+		"XSHA256": commandXHash{HashSHA256},
+		"XSHA512": commandXHash{HashSHA512},
 	}
 )
 
+// commandAbor responds to the ABOR FTP command. It aborts the transfer in
+// progress, if any: the transfer command is answered with 426 and ABOR
+// itself with 226, as described in RFC 959.
+type commandAbor struct{}
+
+func (cmd commandAbor) IsExtend() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAbor) Execute(conn *Conn, param string) {
+	t := conn.currentTransfer()
+	if t == nil {
+		if conn.dataConn != nil {
+			conn.dataConn.Close()
+			conn.dataConn = nil
+		}
+		conn.writeMessage(225, "No transfer to abort")
+		return
+	}
+
+	t.abort()
+	<-t.done
+	conn.writeMessage(226, "ABOR command successful")
+}
+
 // commandAllo responds to the ALLO FTP command.
 //
-// This is essentially a ping from the client so we just respond with an
-// basic OK message.
+// If the driver implements AllocateDriver, the storage is reserved before
+// the next STOR or APPE. Otherwise this is essentially a ping from the
+// client so we just respond with an basic OK message.
 type commandAllo struct{}
 
 func (cmd commandAllo) IsExtend() bool {
@@ -90,7 +160,42 @@ func (cmd commandAllo) RequireAuth() bool {
 }
 
 func (cmd commandAllo) Execute(conn *Conn, param string) {
-	conn.writeMessage(202, "Obsolete")
+	if _, ok := unwrapDriver(conn.driver).(AllocateDriver); !ok {
+		conn.writeMessage(202, "Obsolete")
+		return
+	}
+	// the optional record size is ignored
+	fields := strings.Fields(param)
+	if len(fields) == 0 {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		conn.writeMessage(501, "Invalid size "+fields[0])
+		return
+	}
+	conn.allocSize = size
+	conn.writeMessage(200, fmt.Sprintf("ALLO command successful, %d bytes will be reserved", size))
+}
+
+// allocate reserves the storage announced by ALLO for an upload to name,
+// replying with an error and returning false if that failed.
+func (conn *Conn) allocate(name string) bool {
+	size := conn.allocSize
+	conn.allocSize = 0
+	driver, ok := unwrapDriver(conn.driver).(AllocateDriver)
+	if !ok || size == 0 {
+		return true
+	}
+	err := conn.accounted(name, size, func() error {
+		return driver.Allocate(name, size)
+	})
+	if err != nil {
+		conn.replyError(552, err)
+		return false
+	}
+	return true
 }
 
 // commandAppe responds to the APPE FTP command. It allows the user to upload a
@@ -111,15 +216,13 @@ func (cmd commandAppe) RequireAuth() bool {
 
 func (cmd commandAppe) Execute(conn *Conn, param string) {
 	targetPath := conn.buildPath(param)
-	conn.writeMessage(150, "Data transfer starting")
-
-	bytes, err := conn.driver.PutFile(targetPath, conn.dataConn, true)
-	if err == nil {
-		msg := "OK, received " + strconv.Itoa(int(bytes)) + " bytes"
-		conn.writeMessage(226, msg)
-	} else {
-		conn.writeMessage(450, fmt.Sprint("error during transfer: ", err))
+	if !conn.allocate(targetPath) {
+		return
 	}
+	conn.writeMessage(150, "Data transfer starting")
+	conn.receiveOutofBandData(func(ctx context.Context, data io.Reader) (int64, error) {
+		return conn.driver.PutFile(ctx, targetPath, data, true)
+	})
 }
 
 type commandOpts struct{}
@@ -138,19 +241,53 @@ func (cmd commandOpts) RequireAuth() bool {
 
 func (cmd commandOpts) Execute(conn *Conn, param string) {
 	parts := strings.Fields(param)
-	if len(parts) != 2 {
-		conn.writeMessage(550, "Unknow params")
-		return
-	}
-	if strings.ToUpper(parts[0]) != "UTF8" {
+	if len(parts) == 0 {
 		conn.writeMessage(550, "Unknow params")
 		return
 	}
 
-	if strings.ToUpper(parts[1]) == "ON" {
-		conn.writeMessage(200, "UTF8 mode enabled")
-	} else {
-		conn.writeMessage(550, "Unsupported non-utf8 mode")
+	switch strings.ToUpper(parts[0]) {
+	case "UTF8":
+		if len(parts) != 2 {
+			conn.writeMessage(550, "Unknow params")
+		} else if strings.ToUpper(parts[1]) == "ON" {
+			conn.writeMessage(200, "UTF8 mode enabled")
+		} else {
+			conn.writeMessage(550, "Unsupported non-utf8 mode")
+		}
+	case "HASH":
+		if len(parts) == 1 {
+			conn.writeMessage(200, conn.hashAlgo)
+			return
+		}
+		algo := parseHashAlgo(parts[1])
+		if algo == "" {
+			conn.writeMessage(501, "Unknown algorithm, current selection not changed")
+			return
+		}
+		conn.hashAlgo = algo
+		conn.writeMessage(200, algo)
+	case "MODE":
+		if len(parts) == 4 && strings.ToUpper(parts[1]) == "Z" && strings.ToUpper(parts[2]) == "LEVEL" {
+			level, err := strconv.Atoi(parts[3])
+			if err != nil || level < zlib.NoCompression || level > zlib.BestCompression {
+				conn.writeMessage(501, "Invalid MODE Z LEVEL")
+				return
+			}
+			conn.zlibLevel = level
+			conn.writeMessage(200, "MODE Z LEVEL set to "+parts[3])
+		} else {
+			conn.writeMessage(501, "Unsupported MODE options")
+		}
+	case "MLST":
+		var facts string
+		if len(parts) > 1 {
+			facts = parts[1]
+		}
+		conn.mlstFacts = parseMlstFacts(facts)
+		conn.writeMessage(200, "MLST OPTS "+mlstFactList(conn.mlstFacts))
+	default:
+		conn.writeMessage(550, "Unknow params")
 	}
 }
 
@@ -168,21 +305,37 @@ func (cmd commandFeat) RequireAuth() bool {
 	return false
 }
 
-var (
-	feats    = "Extensions supported:\n%s"
-	featCmds = " UTF8\n"
-)
-
-func init() {
-	for k, v := range commands {
-		if v.IsExtend() {
-			featCmds = featCmds + " " + k + "\n"
+func (cmd commandFeat) Execute(conn *Conn, param string) {
+	var feats []string
+	add := func(command, feat string) {
+		if conn.commandEnabled(command) {
+			feats = append(feats, feat)
 		}
 	}
-}
+	add("OPTS", "UTF8")
+	if conn.server.TLS {
+		add("AUTH", "AUTH TLS")
+		add("PBSZ", "PBSZ")
+		add("PROT", "PROT")
+	}
+	if _, ok := unwrapDriver(conn.driver).(StatFSDriver); ok || conn.quota != nil {
+		add("AVBL", "AVBL")
+	}
+	add("HASH", "HASH "+hashFeat(conn.hashAlgo))
+	if implements(conn.driver, "", isTimesDriver) {
+		if creationTimeSupported(conn.driver) {
+			add("MFCT", "MFCT")
+		}
+		add("MFMT", "MFMT")
+	}
+	add("MLST", "MLST "+mlstFeat(conn.mlstFacts))
+	add("MODE", "MODE Z")
+	for _, name := range conn.server.extensions() {
+		add(name, name)
+	}
+	sort.Strings(feats)
 
-func (cmd commandFeat) Execute(conn *Conn, param string) {
-	conn.writeMessageMultiline(211, conn.server.feats)
+	conn.writeMessageMultiline(211, "Extensions supported:\n "+strings.Join(feats, "\n ")+"\n")
 }
 
 // cmdCdup responds to the CDUP FTP command.
@@ -225,12 +378,12 @@ func (cmd commandCwd) RequireAuth() bool {
 
 func (cmd commandCwd) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
-	err := conn.driver.ChangeDir(path)
+	err := conn.driver.ChangeDir(conn.Context(), path)
 	if err == nil {
 		conn.namePrefix = path
 		conn.writeMessage(250, "Directory changed to "+path)
 	} else {
-		conn.writeMessage(550, fmt.Sprint("Directory change to ", path, " failed: ", err))
+		conn.replyError(550, err)
 	}
 }
 
@@ -252,11 +405,11 @@ func (cmd commandDele) RequireAuth() bool {
 
 func (cmd commandDele) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
-	err := conn.driver.DeleteFile(path)
+	err := conn.driver.DeleteFile(conn.Context(), path)
 	if err == nil {
 		conn.writeMessage(250, "File deleted")
 	} else {
-		conn.writeMessage(550, fmt.Sprint("File delete failed: ", err))
+		conn.replyError(550, err)
 	}
 }
 
@@ -278,15 +431,24 @@ func (cmd commandEprt) RequireAuth() bool {
 }
 
 func (cmd commandEprt) Execute(conn *Conn, param string) {
-	delim := string(param[0:1])
-	parts := strings.Split(param, delim)
-	addressFamily, err := strconv.Atoi(parts[1])
-	host := parts[2]
-	port, err := strconv.Atoi(parts[3])
+	if conn.epsvAll {
+		conn.writeMessage(503, "EPSV ALL in effect, only EPSV is allowed")
+		return
+	}
+	addressFamily, host, port, err := parseEprtParam(param)
+	if err != nil {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
 	if addressFamily != 1 && addressFamily != 2 {
 		conn.writeMessage(522, "Network protocol not supported, use (1,2)")
 		return
 	}
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != (addressFamily == 1) {
+		conn.writeMessage(501, "Address does not match the network protocol")
+		return
+	}
 	socket, err := newActiveSocket(host, port, conn.logger, conn.sessionID)
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -296,6 +458,31 @@ func (cmd commandEprt) Execute(conn *Conn, param string) {
 	conn.writeMessage(200, "Connection established ("+strconv.Itoa(port)+")")
 }
 
+// parseEprtParam parses the parameter of EPRT as described in RFC 2428,
+// for example "|2|1080::8:800:200C:417A|5282|".
+func parseEprtParam(param string) (addressFamily int, host string, port int, err error) {
+	if len(param) == 0 {
+		return 0, "", 0, errors.New("empty EPRT parameter")
+	}
+	delim := param[0:1]
+	parts := strings.Split(param, delim)
+	if len(parts) != 5 || parts[0] != "" || parts[4] != "" {
+		return 0, "", 0, errors.New("malformed EPRT parameter")
+	}
+	addressFamily, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, "", 0, err
+	}
+	port, err = strconv.Atoi(parts[3])
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if port <= 0 || port > 65535 {
+		return 0, "", 0, errors.New("invalid EPRT port")
+	}
+	return addressFamily, parts[2], port, nil
+}
+
 // commandLprt responds to the LPRT FTP command. It allows the client to
 // request an active data socket with more options than the original PORT
 // command.  FTP Operation Over Big Address Records.
@@ -314,39 +501,45 @@ func (cmd commandLprt) RequireAuth() bool {
 }
 
 func (cmd commandLprt) Execute(conn *Conn, param string) {
-	// No tests for this code yet
+	if conn.epsvAll {
+		conn.writeMessage(503, "EPSV ALL in effect, only EPSV is allowed")
+		return
+	}
 
+	// af,hal,h1,h2,h3,h4,pal,p1,p2 with IPv4 only
 	parts := strings.Split(param, ",")
-
-	addressFamily, err := strconv.Atoi(parts[0])
-	if addressFamily != 4 {
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 || n > 255 {
+			conn.writeMessage(501, "Syntax error in parameters or arguments")
+			return
+		}
+		nums[i] = n
+	}
+	if len(nums) < 2 {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	if nums[0] != 4 {
 		conn.writeMessage(522, "Network protocol not supported, use 4")
 		return
 	}
-
-	addressLength, err := strconv.Atoi(parts[1])
-	if addressLength != 4 {
+	if nums[1] != 4 {
 		conn.writeMessage(522, "Network IP length not supported, use 4")
 		return
 	}
-
-	host := strings.Join(parts[2:2+addressLength], ".")
-
-	portLength, err := strconv.Atoi(parts[2+addressLength])
-	portAddress := parts[3+addressLength : 3+addressLength+portLength]
-
-	// Convert string[] to byte[]
-	portBytes := make([]byte, portLength)
-	for i := range portAddress {
-		p, _ := strconv.Atoi(portAddress[i])
-		portBytes[i] = byte(p)
+	if len(nums) != 9 || nums[6] != 2 {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
 	}
 
-	// convert the bytes to an int
-	port := int(binary.BigEndian.Uint16(portBytes))
+	host := fmt.Sprintf("%d.%d.%d.%d", nums[2], nums[3], nums[4], nums[5])
+	port := int(binary.BigEndian.Uint16([]byte{byte(nums[7]), byte(nums[8])}))
 
 	// if the existing connection is on the same host/port don't reconnect
-	if conn.dataConn.Host() == host && conn.dataConn.Port() == port {
+	if conn.dataConn != nil && conn.dataConn.Host() == host && conn.dataConn.Port() == port {
+		conn.writeMessage(200, "Connection established ("+strconv.Itoa(port)+")")
 		return
 	}
 
@@ -361,7 +554,11 @@ func (cmd commandLprt) Execute(conn *Conn, param string) {
 
 // commandEpsv responds to the EPSV FTP command. It allows the client to
 // request a passive data socket with more options than the original PASV
-// command. It mainly adds ipv6 support, although we don't support that yet.
+// command. It mainly adds ipv6 support.
+//
+// The optional parameter is either the network protocol the client wants
+// to use, 1 for IPv4 or 2 for IPv6, or ALL to tell the server that only
+// EPSV will be used to set up data connections from now on.
 type commandEpsv struct{}
 
 func (cmd commandEpsv) IsExtend() bool {
@@ -377,6 +574,22 @@ func (cmd commandEpsv) RequireAuth() bool {
 }
 
 func (cmd commandEpsv) Execute(conn *Conn, param string) {
+	switch strings.ToUpper(param) {
+	case "":
+	case "ALL":
+		conn.epsvAll = true
+		conn.writeMessage(200, "EPSV ALL command successful")
+		return
+	case "1", "2":
+		if family := conn.controlAddressFamily(); param != strconv.Itoa(family) {
+			conn.writeMessage(522, fmt.Sprintf("Network protocol not supported, use (%d)", family))
+			return
+		}
+	default:
+		conn.writeMessage(522, fmt.Sprintf("Network protocol not supported, use (%d)", conn.controlAddressFamily()))
+		return
+	}
+
 	addr := conn.passiveListenIP()
 	socket, err := newPassiveSocket(addr, conn.PassivePort, conn.logger, conn.sessionID, conn.tlsConfig)
 	if err != nil {
@@ -389,6 +602,196 @@ func (cmd commandEpsv) Execute(conn *Conn, param string) {
 	conn.writeMessage(229, msg)
 }
 
+// commandHash responds to the HASH FTP command from draft-bryan-ftpext-hash.
+// It returns the checksum of a file, or of the byte range selected with
+// RANG, using the algorithm selected with OPTS HASH.
+type commandHash struct{}
+
+func (cmd commandHash) IsExtend() bool {
+	return false
+}
+
+func (cmd commandHash) RequireParam() bool {
+	return true
+}
+
+func (cmd commandHash) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandHash) Execute(conn *Conn, param string) {
+	path := conn.buildPath(param)
+	start, end := conn.rangeStart, conn.rangeEnd
+	defer func() {
+		conn.rangeStart = 0
+		conn.rangeEnd = -1
+	}()
+
+	info, err := conn.driver.Stat(conn.Context(), path)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	if info.IsDir() {
+		conn.writeMessage(553, param+" is not a file")
+		return
+	}
+	// end stays negative for the whole file, so that a HashDriver is used
+	size := info.Size()
+	if end > size {
+		end = size
+	}
+	last := size
+	if end >= 0 {
+		last = end
+	}
+	if start > last {
+		conn.writeMessage(501, "Invalid byte range")
+		return
+	}
+	if start == 0 && end == size {
+		end = -1
+	}
+
+	sum, err := conn.fileHash(path, conn.hashAlgo, start, end)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	// the reply shows the inclusive end, like RANG
+	if last > start {
+		last--
+	}
+	conn.writeMessage(213, fmt.Sprintf("%s %d-%d %s %s", conn.hashAlgo, start, last, sum, param))
+}
+
+// commandRang responds to the RANG FTP command from draft-bryan-ftp-range.
+// It selects the inclusive byte range used by the next HASH command only,
+// RETR and STOR ignore it, so it is not advertised by FEAT. "RANG 1 0"
+// resets the range.
+type commandRang struct{}
+
+func (cmd commandRang) IsExtend() bool {
+	return false
+}
+
+func (cmd commandRang) RequireParam() bool {
+	return true
+}
+
+func (cmd commandRang) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandRang) Execute(conn *Conn, param string) {
+	parts := strings.Fields(param)
+	if len(parts) != 2 {
+		conn.writeMessage(501, "Syntax error, RANG requires a start and an end point")
+		return
+	}
+	start, err1 := strconv.ParseInt(parts[0], 10, 64)
+	end, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < 0 {
+		conn.writeMessage(501, "Invalid byte range")
+		return
+	}
+
+	if start == 1 && end == 0 {
+		conn.rangeStart = 0
+		conn.rangeEnd = -1
+		conn.writeMessage(350, "Resetting range")
+		return
+	}
+	if start > end {
+		conn.writeMessage(501, "Invalid byte range")
+		return
+	}
+	conn.rangeStart = start
+	conn.rangeEnd = end + 1
+	conn.writeMessage(350, fmt.Sprintf("Restarting at %d. Ending byte at %d", start, end))
+}
+
+// commandXHash responds to the XCRC, XMD5, XSHA1, XSHA256 and XSHA512 FTP
+// commands. Each returns the checksum of a file with a fixed algorithm,
+// optionally restricted to the bytes between a start and an end offset
+// given after the file name.
+type commandXHash struct {
+	algo string
+}
+
+func (cmd commandXHash) IsExtend() bool {
+	return true
+}
+
+func (cmd commandXHash) RequireParam() bool {
+	return true
+}
+
+func (cmd commandXHash) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandXHash) Execute(conn *Conn, param string) {
+	name, start, end := parseXHashParam(param)
+	path := conn.buildPath(name)
+
+	info, err := conn.driver.Stat(conn.Context(), path)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	if info.IsDir() {
+		conn.writeMessage(553, name+" is not a file")
+		return
+	}
+	if end < 0 || end > info.Size() {
+		end = info.Size()
+	}
+	if start > end {
+		conn.writeMessage(501, "Invalid byte range")
+		return
+	}
+	if start == 0 && end == info.Size() {
+		end = -1
+	}
+
+	sum, err := conn.fileHash(path, cmd.algo, start, end)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(250, sum)
+}
+
+// parseXHashParam splits the parameter of the X* checksum commands into the
+// file name and an optional byte range given by two trailing numbers. The
+// file name may be quoted when it contains spaces.
+func parseXHashParam(param string) (name string, start, end int64) {
+	name, start, end = param, 0, -1
+	fields := strings.Fields(param)
+	if len(fields) >= 3 {
+		s, err1 := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+		e, err2 := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err1 == nil && err2 == nil && s >= 0 && e >= 0 {
+			name = trimLastFields(param, fields, 2)
+			start, end = s, e
+		}
+	}
+	if len(name) > 1 && name[0] == '"' && name[len(name)-1] == '"' {
+		name = name[1 : len(name)-1]
+	}
+	return
+}
+
+// trimLastFields removes the last n of the fields of s, as returned by
+// strings.Fields, keeping any spaces inside the remaining part.
+func trimLastFields(s string, fields []string, n int) string {
+	for i := 1; i <= n; i++ {
+		s = strings.TrimSuffix(strings.TrimRight(s, " "), fields[len(fields)-i])
+	}
+	return strings.TrimSpace(s)
+}
+
 // commandList responds to the LIST FTP command. It allows the client to retreive
 // a detailed listing of the contents of a directory.
 type commandList struct{}
@@ -407,9 +810,9 @@ func (cmd commandList) RequireAuth() bool {
 
 func (cmd commandList) Execute(conn *Conn, param string) {
 	path := conn.buildPath(parseListParam(param))
-	info, err := conn.driver.Stat(path)
+	info, err := conn.driver.Stat(conn.Context(), path)
 	if err != nil {
-		conn.writeMessage(550, err.Error())
+		conn.replyError(550, err)
 		return
 	}
 
@@ -419,12 +822,12 @@ func (cmd commandList) Execute(conn *Conn, param string) {
 	}
 	var files []FileInfo
 	if info.IsDir() {
-		err = conn.driver.ListDir(path, func(f FileInfo) error {
+		err = conn.driver.ListDir(conn.Context(), path, func(f FileInfo) error {
 			files = append(files, f)
 			return nil
 		})
 		if err != nil {
-			conn.writeMessage(550, err.Error())
+			conn.replyError(550, err)
 			return
 		}
 	} else {
@@ -470,9 +873,9 @@ func (cmd commandNlst) RequireAuth() bool {
 
 func (cmd commandNlst) Execute(conn *Conn, param string) {
 	path := conn.buildPath(parseListParam(param))
-	info, err := conn.driver.Stat(path)
+	info, err := conn.driver.Stat(conn.Context(), path)
 	if err != nil {
-		conn.writeMessage(550, err.Error())
+		conn.replyError(550, err)
 		return
 	}
 	if !info.IsDir() {
@@ -481,12 +884,12 @@ func (cmd commandNlst) Execute(conn *Conn, param string) {
 	}
 
 	var files []FileInfo
-	err = conn.driver.ListDir(path, func(f FileInfo) error {
+	err = conn.driver.ListDir(conn.Context(), path, func(f FileInfo) error {
 		files = append(files, f)
 		return nil
 	})
 	if err != nil {
-		conn.writeMessage(550, err.Error())
+		conn.replyError(550, err)
 		return
 	}
 	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
@@ -511,12 +914,175 @@ func (cmd commandMdtm) RequireAuth() bool {
 
 func (cmd commandMdtm) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
-	stat, err := conn.driver.Stat(path)
+	stat, err := conn.driver.Stat(conn.Context(), path)
 	if err == nil {
 		conn.writeMessage(213, stat.ModTime().Format("20060102150405"))
 	} else {
-		conn.writeMessage(450, "File not available")
+		conn.replyError(550, err)
+	}
+}
+
+// commandMlsd responds to the MLSD FTP command. It allows the client to
+// retreive a machine readable listing of a directory, as described in
+// RFC 3659.
+type commandMlsd struct{}
+
+func (cmd commandMlsd) IsExtend() bool {
+	return false
+}
+
+func (cmd commandMlsd) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlsd) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlsd) Execute(conn *Conn, param string) {
+	path := conn.buildPath(param)
+	info, err := conn.driver.Stat(conn.Context(), path)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	if !info.IsDir() {
+		conn.writeMessage(501, param+" is not a directory")
+		return
+	}
+
+	var files []FileInfo
+	err = conn.driver.ListDir(conn.Context(), path, func(f FileInfo) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
+	conn.sendOutofbandData(listFormatter(files).Machine(path, conn.mlstFacts))
+}
+
+// commandMlst responds to the MLST FTP command. It returns the facts of a
+// single file or directory over the control connection, as described in
+// RFC 3659.
+type commandMlst struct{}
+
+func (cmd commandMlst) IsExtend() bool {
+	return false
+}
+
+func (cmd commandMlst) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlst) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlst) Execute(conn *Conn, param string) {
+	path := conn.buildPath(param)
+	info, err := conn.driver.Stat(conn.Context(), path)
+	if err != nil {
+		conn.replyError(550, err)
+		return
 	}
+	facts := mlstEntry(info, path, conn.mlstFacts)
+	conn.writeMessageMultiline(250, "Listing "+path+"\r\n "+facts+path)
+}
+
+// commandMfmt responds to the MFMT FTP command from
+// draft-somers-ftp-mfxx. It allows the client to set the last modified time
+// of a file.
+type commandMfmt struct{}
+
+func (cmd commandMfmt) IsExtend() bool {
+	return false
+}
+
+func (cmd commandMfmt) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfmt) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfmt) Execute(conn *Conn, param string) {
+	setFileTime(conn, param, "Modify")
+}
+
+// commandMfct responds to the MFCT FTP command from
+// draft-somers-ftp-mfxx. It allows the client to set the creation time of a
+// file.
+type commandMfct struct{}
+
+func (cmd commandMfct) IsExtend() bool {
+	return false
+}
+
+func (cmd commandMfct) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfct) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfct) Execute(conn *Conn, param string) {
+	setFileTime(conn, param, "Create")
+}
+
+// setFileTime implements MFMT and MFCT, whose parameter is a timestamp
+// followed by the path. fact is the name of the fact echoed in the reply.
+func setFileTime(conn *Conn, param string, fact string) {
+	driver, ok := unwrapDriver(conn.driver).(TimesDriver)
+	if !ok || !implements(conn.driver, "", isTimesDriver) || fact == "Create" && !creationTimeSupported(conn.driver) {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+
+	parts := strings.SplitN(param, " ", 2)
+	if len(parts) != 2 {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	t, err := parseTimeVal(parts[0])
+	if err != nil {
+		conn.writeMessage(501, "Invalid time value")
+		return
+	}
+
+	path := conn.buildPath(parts[1])
+	if fact == "Create" {
+		err = driver.SetTimes(path, time.Time{}, time.Time{}, t)
+	} else {
+		err = driver.SetTimes(path, time.Time{}, t, time.Time{})
+	}
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(213, fmt.Sprintf("%s=%s; %s", fact, parts[0], parts[1]))
+}
+
+// creationTimeSupported reports whether driver can set the creation time of
+// files, see CreationTimeDriver.
+func creationTimeSupported(driver DriverV2) bool {
+	d, ok := unwrapDriver(driver).(CreationTimeDriver)
+	return ok && d.CreationTimeSupported()
+}
+
+// parseTimeVal parses a time-val as defined by RFC 3659, that is
+// YYYYMMDDHHMMSS with an optional fraction of seconds, in UTC. For the
+// benefit of SITE UTIME the seconds may also be omitted.
+func parseTimeVal(value string) (time.Time, error) {
+	layout := "20060102150405"
+	if len(value) == len("200601021504") {
+		layout = "200601021504"
+	}
+	return time.ParseInLocation(layout, value, time.UTC)
 }
 
 // commandMkd responds to the MKD FTP command. It allows the client to create
@@ -537,11 +1103,11 @@ func (cmd commandMkd) RequireAuth() bool {
 
 func (cmd commandMkd) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
-	err := conn.driver.MakeDir(path)
+	err := conn.driver.MakeDir(conn.Context(), path)
 	if err == nil {
 		conn.writeMessage(257, "Directory created")
 	} else {
-		conn.writeMessage(550, fmt.Sprint("Action not taken: ", err))
+		conn.replyError(550, err)
 	}
 }
 
@@ -551,6 +1117,10 @@ func (cmd commandMkd) Execute(conn *Conn, param string) {
 // would be sent over the data socket, In reality these days (S)tream mode
 // is all that is used for the mode - data is just streamed down the data
 // socket unchanged.
+//
+// The one exception is the deflate mode Z from draft-preston-ftpext-deflate,
+// which compresses the data stream with zlib to save bandwidth on slow
+// links. The level can be chosen with OPTS MODE Z LEVEL.
 type commandMode struct{}
 
 func (cmd commandMode) IsExtend() bool {
@@ -566,9 +1136,14 @@ func (cmd commandMode) RequireAuth() bool {
 }
 
 func (cmd commandMode) Execute(conn *Conn, param string) {
-	if strings.ToUpper(param) == "S" {
+	switch strings.ToUpper(param) {
+	case "S":
+		conn.transferMode = "S"
 		conn.writeMessage(200, "OK")
-	} else {
+	case "Z":
+		conn.transferMode = "Z"
+		conn.writeMessage(200, "MODE Z ok")
+	default:
 		conn.writeMessage(504, "MODE is an obsolete command")
 	}
 }
@@ -619,8 +1194,20 @@ func (cmd commandPass) Execute(conn *Conn, param string) {
 	}
 
 	if ok {
+		// the restrictions of a previous login are kept until now
+		conn.logout()
 		conn.user = conn.reqUser
 		conn.reqUser = ""
+		conn.loginDriver = conn.driver
+		if conn.server.OnLogin != nil {
+			if err := conn.server.OnLogin(conn); err != nil {
+				conn.logout()
+				conn.writeMessage(530, fmt.Sprint("Login refused: ", err))
+				return
+			}
+		}
+		// the options of the server apply to the driver chosen by OnLogin
+		conn.driver = wrapRestricted(conn.driver, conn.enforceOpts)
 		conn.writeMessage(230, "Password ok, continue")
 	} else {
 		conn.writeMessage(530, "Incorrect password, not logged in")
@@ -646,7 +1233,17 @@ func (cmd commandPasv) RequireAuth() bool {
 }
 
 func (cmd commandPasv) Execute(conn *Conn, param string) {
+	if conn.epsvAll {
+		conn.writeMessage(503, "EPSV ALL in effect, only EPSV is allowed")
+		return
+	}
 	listenIP := conn.passiveListenIP()
+	ip := net.ParseIP(listenIP).To4()
+	if ip == nil {
+		// PASV can only describe IPv4 addresses, RFC 2428 clients use EPSV
+		conn.writeMessage(522, "Network protocol not supported, use EPSV")
+		return
+	}
 	socket, err := newPassiveSocket(listenIP, conn.PassivePort, conn.logger, conn.sessionID, conn.tlsConfig)
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -655,8 +1252,7 @@ func (cmd commandPasv) Execute(conn *Conn, param string) {
 	conn.dataConn = socket
 	p1 := socket.Port() / 256
 	p2 := socket.Port() - (p1 * 256)
-	quads := strings.Split(listenIP, ".")
-	target := fmt.Sprintf("(%s,%s,%s,%s,%d,%d)", quads[0], quads[1], quads[2], quads[3], p1, p2)
+	target := fmt.Sprintf("(%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], p1, p2)
 	msg := "Entering Passive Mode " + target
 	conn.writeMessage(227, msg)
 }
@@ -680,7 +1276,15 @@ func (cmd commandPort) RequireAuth() bool {
 }
 
 func (cmd commandPort) Execute(conn *Conn, param string) {
+	if conn.epsvAll {
+		conn.writeMessage(503, "EPSV ALL in effect, only EPSV is allowed")
+		return
+	}
 	nums := strings.Split(param, ",")
+	if len(nums) != 6 {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
 	portOne, _ := strconv.Atoi(nums[4])
 	portTwo, _ := strconv.Atoi(nums[5])
 	port := (portOne * 256) + portTwo
@@ -758,17 +1362,12 @@ func (cmd commandRetr) Execute(conn *Conn, param string) {
 		conn.lastFilePos = 0
 		conn.appendData = false
 	}()
-	bytes, data, err := conn.driver.GetFile(path, conn.lastFilePos)
-	if err == nil {
-		defer data.Close()
-		conn.writeMessage(150, fmt.Sprintf("Data transfer starting %v bytes", bytes))
-		err = conn.sendOutofBandDataWriter(data)
-		if err != nil {
-			conn.writeMessage(551, "Error reading file")
-		}
-	} else {
-		conn.writeMessage(551, "File not available")
-	}
+	offset := conn.lastFilePos
+	conn.writeMessage(150, "Data transfer starting")
+	conn.sendOutofBandDataWriter(func(ctx context.Context) (io.ReadCloser, error) {
+		_, data, err := conn.driver.GetFile(ctx, path, offset)
+		return data, err
+	})
 }
 
 type commandRest struct{}
@@ -792,8 +1391,16 @@ func (cmd commandRest) Execute(conn *Conn, param string) {
 		conn.writeMessage(551, "File not available")
 		return
 	}
+	// In ASCII mode the offset would count bytes of the translated data,
+	// which cannot be mapped to the file without reading it.
+	if conn.transferType == "A" && conn.lastFilePos != 0 {
+		conn.lastFilePos = 0
+		conn.writeMessage(504, "REST not supported in ASCII mode, use TYPE I")
+		return
+	}
 
 	conn.appendData = true
+	conn.state = stateRestart
 
 	conn.writeMessage(350, fmt.Sprint("Start transfer from ", conn.lastFilePos))
 }
@@ -816,6 +1423,7 @@ func (cmd commandRnfr) RequireAuth() bool {
 
 func (cmd commandRnfr) Execute(conn *Conn, param string) {
 	conn.renameFrom = conn.buildPath(param)
+	conn.state = stateRename
 	conn.writeMessage(350, "Requested file action pending further information.")
 }
 
@@ -837,7 +1445,7 @@ func (cmd commandRnto) RequireAuth() bool {
 
 func (cmd commandRnto) Execute(conn *Conn, param string) {
 	toPath := conn.buildPath(param)
-	err := conn.driver.Rename(conn.renameFrom, toPath)
+	err := conn.driver.Rename(conn.Context(), conn.renameFrom, toPath)
 	defer func() {
 		conn.renameFrom = ""
 	}()
@@ -845,7 +1453,7 @@ func (cmd commandRnto) Execute(conn *Conn, param string) {
 	if err == nil {
 		conn.writeMessage(250, "File renamed")
 	} else {
-		conn.writeMessage(550, fmt.Sprint("Action not taken: ", err))
+		conn.replyError(550, err)
 	}
 }
 
@@ -867,11 +1475,11 @@ func (cmd commandRmd) RequireAuth() bool {
 
 func (cmd commandRmd) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
-	err := conn.driver.DeleteDir(path)
+	err := conn.driver.DeleteDir(conn.Context(), path)
 	if err == nil {
 		conn.writeMessage(250, "Directory deleted")
 	} else {
-		conn.writeMessage(550, fmt.Sprint("Directory delete failed: ", err))
+		conn.replyError(550, err)
 	}
 }
 
@@ -1054,18 +1662,82 @@ func (cmd commandSize) RequireAuth() bool {
 }
 
 func (cmd commandSize) Execute(conn *Conn, param string) {
+	// RFC 3659 defines SIZE as the size of the transferred data, which in
+	// ASCII mode can only be known by translating the whole file.
+	if conn.transferType == "A" {
+		conn.writeMessage(550, "SIZE not allowed in ASCII mode")
+		return
+	}
 	path := conn.buildPath(param)
-	stat, err := conn.driver.Stat(path)
+	stat, err := conn.driver.Stat(conn.Context(), path)
 	if err != nil {
-		log.Printf("Size: error(%s)", err)
-		conn.writeMessage(450, fmt.Sprint("path", path, "not found"))
+		conn.replyError(550, err)
 	} else {
 		conn.writeMessage(213, strconv.Itoa(int(stat.Size())))
 	}
 }
 
+// commandStat responds to the STAT FTP command. Without a parameter it
+// returns the status of the session; with a path it returns a detailed
+// listing of it over the control connection, for clients that cannot open
+// a data connection.
+type commandStat struct{}
+
+func (cmd commandStat) IsExtend() bool {
+	return false
+}
+
+func (cmd commandStat) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStat) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandStat) Execute(conn *Conn, param string) {
+	if param == "" {
+		conn.writeMessageMultiline(211, conn.status())
+		return
+	}
+	if !conn.IsLogin() {
+		conn.writeMessage(530, "not logged in")
+		return
+	}
+
+	path := conn.buildPath(parseListParam(param))
+	info, err := conn.driver.Stat(conn.Context(), path)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	// RFC 959 uses 212 for the status of a directory, 213 for a file
+	code := 213
+	var files []FileInfo
+	if info.IsDir() {
+		code = 212
+		err = conn.driver.ListDir(conn.Context(), path, func(f FileInfo) error {
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			conn.replyError(550, err)
+			return
+		}
+	} else {
+		files = append(files, info)
+	}
+
+	listing := strings.TrimSuffix(string(listFormatter(files).Detailed()), "\r\n")
+	if listing == "" {
+		conn.writeMessageMultiline(code, "Status of "+path+":")
+	} else {
+		conn.writeMessageMultiline(code, "Status of "+path+":\r\n"+listing)
+	}
+}
+
 // commandStor responds to the STOR FTP command. It allows the user to upload a
-// new file.
+// new file, or to resume an upload from the offset given by REST.
 type commandStor struct{}
 
 func (cmd commandStor) IsExtend() bool {
@@ -1082,19 +1754,63 @@ func (cmd commandStor) RequireAuth() bool {
 
 func (cmd commandStor) Execute(conn *Conn, param string) {
 	targetPath := conn.buildPath(param)
-	conn.writeMessage(150, "Data transfer starting")
-
 	defer func() {
+		conn.lastFilePos = 0
 		conn.appendData = false
+		conn.allocSize = 0
 	}()
 
-	bytes, err := conn.driver.PutFile(targetPath, conn.dataConn, conn.appendData)
-	if err == nil {
-		msg := "OK, received " + strconv.Itoa(int(bytes)) + " bytes"
-		conn.writeMessage(226, msg)
-	} else {
-		conn.writeMessage(450, fmt.Sprint("error during transfer: ", err))
+	store := func(ctx context.Context, data io.Reader) (int64, error) {
+		return conn.driver.PutFile(ctx, targetPath, data, false)
+	}
+	resume := conn.appendData && conn.lastFilePos > 0
+	if offset := conn.lastFilePos; resume {
+		if putFileAt := restarter(conn.driver, targetPath); putFileAt != nil {
+			store = func(ctx context.Context, data io.Reader) (int64, error) {
+				return putFileAt(ctx, targetPath, offset, data)
+			}
+		} else {
+			// the data can only be appended, after truncating the file
+			info, err := conn.driver.Stat(conn.Context(), targetPath)
+			if err != nil {
+				conn.replyError(550, err)
+				return
+			}
+			truncater, ok := unwrapDriver(conn.driver).(TruncateDriver)
+			ok = ok && implements(conn.driver, targetPath, isTruncateDriver)
+			if info.Size() != offset && !ok {
+				conn.writeMessage(554, "Invalid REST parameter, uploads can only be resumed from the end of the file")
+				return
+			}
+			if offset > info.Size() {
+				conn.writeMessage(554, "Invalid REST parameter, beyond the end of the file")
+				return
+			}
+			if offset < info.Size() {
+				err = conn.accounted(targetPath, 0, func() error {
+					return truncater.Truncate(targetPath, offset)
+				})
+				if err != nil {
+					conn.replyError(550, err)
+					return
+				}
+			}
+			store = func(ctx context.Context, data io.Reader) (int64, error) {
+				return conn.driver.PutFile(ctx, targetPath, data, true)
+			}
+		}
 	}
+
+	// atomic uploads write a new file under a temporary name, which
+	// cannot be reserved in advance
+	if conn.server.AtomicUploads && !resume {
+		conn.allocSize = 0
+	}
+	if !conn.allocate(targetPath) {
+		return
+	}
+	conn.writeMessage(150, "Data transfer starting")
+	conn.receiveOutofBandData(store)
 }
 
 // commandStru responds to the STRU FTP command.
@@ -1153,10 +1869,10 @@ func (cmd commandSyst) Execute(conn *Conn, param string) {
 //  protocol was more aware of the content of the files it was transferring, and
 //  would sometimes be expected to translate things like EOL markers on the fly.
 //
-//  Valid options were A(SCII), I(mage), E(BCDIC) or LN (for local type). Since
-//  we plan to just accept bytes from the client unchanged, I think Image mode is
-//  adequate. The RFC requires we accept ASCII mode however, so accept it, but
-//  ignore it.
+//  Valid options were A(SCII), I(mage), E(BCDIC) or LN (for local type). Image
+//  mode sends the bytes unchanged. The RFC requires we accept ASCII mode too,
+//  in which RETR, STOR and APPE translate line endings between the local LF
+//  and the CRLF used on the wire.
 type commandType struct{}
 
 func (cmd commandType) IsExtend() bool {
@@ -1173,8 +1889,13 @@ func (cmd commandType) RequireAuth() bool {
 
 func (cmd commandType) Execute(conn *Conn, param string) {
 	if strings.ToUpper(param) == "A" {
+		conn.transferType = "A"
+		// restart offsets are not supported in ASCII mode, see REST
+		conn.lastFilePos = 0
+		conn.appendData = false
 		conn.writeMessage(200, "Type set to ASCII")
 	} else if strings.ToUpper(param) == "I" {
+		conn.transferType = "I"
 		conn.writeMessage(200, "Type set to binary")
 	} else {
 		conn.writeMessage(500, "Invalid type")
@@ -1197,10 +1918,11 @@ func (cmd commandUser) RequireAuth() bool {
 }
 
 func (cmd commandUser) Execute(conn *Conn, param string) {
-	conn.reqUser = param
-	if conn.tls || conn.tlsConfig == nil {
-		conn.writeMessage(331, "User name ok, password required")
-	} else {
+	if !conn.tls && conn.tlsConfig != nil {
 		conn.writeMessage(534, "Unsecured login not allowed. AUTH TLS required")
+		return
 	}
+	conn.reqUser = param
+	conn.state = stateUser
+	conn.writeMessage(331, "User name ok, password required")
 }
@@ -4,7 +4,12 @@
 
 package server
 
-import "testing"
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestParseListParam(t *testing.T) {
 	var paramTests = []struct {
@@ -32,3 +37,214 @@ func TestParseListParam(t *testing.T) {
 		}
 	}
 }
+
+func TestParseXHashParam(t *testing.T) {
+	var paramTests = []struct {
+		param string
+		name  string
+		start int64
+		end   int64
+	}{
+		{"file.txt", "file.txt", 0, -1},
+		{"file.txt 10 20", "file.txt", 10, 20},
+		{"hello sausage.txt", "hello sausage.txt", 0, -1},
+		{"hello sausage.txt 0 5", "hello sausage.txt", 0, 5},
+		{"\"hello sausage.txt\" 1 2", "hello sausage.txt", 1, 2},
+		{"file 1", "file 1", 0, -1},
+		{"file 10 10", "file", 10, 10},
+	}
+
+	for _, tt := range paramTests {
+		name, start, end := parseXHashParam(tt.param)
+		if name != tt.name || start != tt.start || end != tt.end {
+			t.Errorf("parseXHashParam(%s): expected %s %d %d, actual %s %d %d", tt.param, tt.name, tt.start, tt.end, name, start, end)
+		}
+	}
+}
+
+func TestParseTimeVal(t *testing.T) {
+	var timeTests = []struct {
+		in  string
+		out time.Time
+		ok  bool
+	}{
+		{"20181008123456", time.Date(2018, 10, 8, 12, 34, 56, 0, time.UTC), true},
+		{"20181008123456.789", time.Date(2018, 10, 8, 12, 34, 56, 789000000, time.UTC), true},
+		{"201810081234", time.Date(2018, 10, 8, 12, 34, 0, 0, time.UTC), true},
+		{"2018-10-08", time.Time{}, false},
+	}
+
+	for _, tt := range timeTests {
+		out, err := parseTimeVal(tt.in)
+		if (err == nil) != tt.ok || !out.Equal(tt.out) {
+			t.Errorf("parseTimeVal(%s): expected %v, actual %v (%v)", tt.in, tt.out, out, err)
+		}
+	}
+}
+
+func TestParseEprtParam(t *testing.T) {
+	var paramTests = []struct {
+		param  string
+		family int
+		host   string
+		port   int
+		ok     bool
+	}{
+		{"|1|132.235.1.2|6275|", 1, "132.235.1.2", 6275, true},
+		{"|2|1080::8:800:200C:417A|5282|", 2, "1080::8:800:200C:417A", 5282, true},
+		{"!2!::1!21!", 2, "::1", 21, true},
+		{"|1|132.235.1.2|", 0, "", 0, false},
+		{"|1|132.235.1.2|99999|", 0, "", 0, false},
+		{"|x|132.235.1.2|21|", 0, "", 0, false},
+		{"", 0, "", 0, false},
+	}
+
+	for _, tt := range paramTests {
+		family, host, port, err := parseEprtParam(tt.param)
+		if (err == nil) != tt.ok || family != tt.family || host != tt.host || port != tt.port {
+			t.Errorf("parseEprtParam(%s): expected %d %s %d, actual %d %s %d (%v)", tt.param, tt.family, tt.host, tt.port, family, host, port, err)
+		}
+	}
+}
+
+type commandXyzzy struct{}
+
+func (cmd commandXyzzy) IsExtend() bool     { return true }
+func (cmd commandXyzzy) RequireParam() bool { return false }
+func (cmd commandXyzzy) RequireAuth() bool  { return false }
+func (cmd commandXyzzy) Execute(conn *Conn, param string) {
+	conn.Reply(200, "Nothing happens at "+conn.BuildPath(param))
+}
+
+func TestRegisterCommand(t *testing.T) {
+	c, replies := newTestConn(nil)
+	defer c.Close()
+	c.server = NewServer(&ServerOpts{Logger: &DiscardLogger{}})
+	c.server.RegisterCommand("xyzzy", commandXyzzy{})
+	c.server.RegisterCommand("SYST", commandXyzzy{})
+	c.server.UnregisterCommand("DELE")
+
+	if _, ok := commands["XYZZY"]; ok {
+		t.Fatal("RegisterCommand must not change the built-in commands")
+	}
+
+	done := sendCommand(c, "XYZZY plugh\r\n")
+	expectReply(t, replies, "200 Nothing happens at /plugh")
+	<-done
+	done = sendCommand(c, "SYST\r\n")
+	expectReply(t, replies, "200 Nothing happens at /")
+	<-done
+	done = sendCommand(c, "DELE file\r\n")
+	expectReply(t, replies, "500")
+	<-done
+
+	done = sendCommand(c, "FEAT\r\n")
+	feats := readMultiline(t, replies)
+	<-done
+	if !strings.Contains(feats, "\n XYZZY\n") {
+		t.Errorf("expected XYZZY in FEAT, got %q", feats)
+	}
+}
+
+func readMultiline(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+		if len(line) > 3 && line[3] == ' ' {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	c, replies := newTestConn(nil)
+	defer c.Close()
+	c.user = ""
+	c.server = NewServer(&ServerOpts{
+		Logger:           &DiscardLogger{},
+		Auth:             &SimpleAuth{Name: "mirror", Password: "secret"},
+		DisabledCommands: []string{"dele", "MFMT"},
+		OnLogin: func(conn *Conn) error {
+			if conn.LoginUser() == "mirror" {
+				conn.AllowCommands("RETR", "FEAT", "HASH", "NOOP")
+			}
+			return nil
+		},
+	})
+
+	var policyTests = []struct {
+		line  string
+		reply string
+	}{
+		{"DELE file", "502"},
+		{"NOOP", "200"},
+		{"USER mirror", "331"},
+		{"PASS secret", "230"},
+		{"NOOP", "200"},
+		{"MKD dir", "502"},
+		{"DELE file", "502"},
+	}
+	for _, tt := range policyTests {
+		done := sendCommand(c, tt.line+"\r\n")
+		expectReply(t, replies, tt.reply)
+		<-done
+	}
+
+	done := sendCommand(c, "FEAT\r\n")
+	feats := readMultiline(t, replies)
+	<-done
+	if !strings.Contains(feats, "\n HASH ") || strings.Contains(feats, "MLST") || strings.Contains(feats, "EPSV") {
+		t.Errorf("unexpected FEAT reply %q", feats)
+	}
+
+	// the restrictions last until another login succeeded
+	for _, tt := range []struct{ line, reply string }{
+		{"USER whoever", "331"},
+		{"MKD dir", "502"},
+		{"USER whoever", "331"},
+		{"PASS wrong", "530"},
+		{"MKD dir", "502"},
+	} {
+		done := sendCommand(c, tt.line+"\r\n")
+		expectReply(t, replies, tt.reply)
+		<-done
+	}
+}
+
+func TestCommandAliases(t *testing.T) {
+	c, replies := newTestConn(newMemDriver(t))
+	defer c.Close()
+	c.server = NewServer(&ServerOpts{
+		Logger:           &DiscardLogger{},
+		DisabledCommands: []string{"MKD", "HASH"},
+	})
+
+	var aliasTests = []struct {
+		line  string
+		reply string
+	}{
+		{"XMKD dir", "502"},
+		{"XMD5 file", "502"},
+		{"HELP XMKD", "502"},
+		{"XPWD", "257"},
+	}
+	for _, tt := range aliasTests {
+		done := sendCommand(c, tt.line+"\r\n")
+		expectReply(t, replies, tt.reply)
+		<-done
+	}
+
+	for _, line := range []string{"HELP", "FEAT"} {
+		done := sendCommand(c, line+"\r\n")
+		reply := readMultiline(t, replies)
+		<-done
+		if strings.Contains(reply, "XMKD") || strings.Contains(reply, "XMD5") || strings.Contains(reply, "XSHA") {
+			t.Errorf("%s lists disabled aliases: %q", line, reply)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
@@ -18,10 +19,14 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
 	defaultWelcomeMessage = "Welcome to the Go FTP Server"
+
+	telnetIP    = "\xff\xf4"
+	telnetSynch = "\xff\xf2"
 )
 
 type Conn struct {
@@ -29,7 +34,7 @@ type Conn struct {
 	controlReader *bufio.Reader
 	controlWriter *bufio.Writer
 	dataConn      DataSocket
-	driver        Driver
+	driver        DriverV2
 	auth          Auth
 	logger        Logger
 	server        *Server
@@ -38,11 +43,175 @@ type Conn struct {
 	namePrefix    string
 	reqUser       string
 	user          string
+	state         sessionState
 	renameFrom    string
+	epsvAll       bool
+	transferType  string
+	transferMode  string
+	zlibLevel     int
+	mlstFacts     []string
+	hashAlgo      string
+	rangeStart    int64
+	rangeEnd      int64
 	lastFilePos   int64
 	appendData    bool
 	closed        bool
 	tls           bool
+	allowedCmds   map[string]bool
+	disabledCmds  map[string]bool
+	quota         *quotaDriver
+	loginDriver   DriverV2 // the driver before the current login
+	copyFrom      string
+	allocSize     int64
+	lock          sync.Mutex // protects transfer
+	transfer      *transfer
+	ctx           context.Context // cancelled when the session ends
+	cancel        context.CancelFunc
+	writeLock     sync.Mutex // serializes replies on the control connection
+}
+
+// SessionID returns the unique identifier of the session, as used in logs.
+func (conn *Conn) SessionID() string {
+	return conn.sessionID
+}
+
+// Driver returns the driver serving the session. A Driver given by a
+// DriverFactory is returned wrapped by AdaptDriver.
+func (conn *Conn) Driver() DriverV2 {
+	return conn.driver
+}
+
+// SetDriver replaces the driver of the session. It is meant to be called
+// from ServerOpts.OnLogin, for example to restrict a user with
+// NewReadOnlyDriver or NewDropBoxDriver.
+func (conn *Conn) SetDriver(driver DriverV2) {
+	conn.driver = driver
+}
+
+// Context returns the context of the session, which is cancelled when the
+// session ends or the server is shut down.
+func (conn *Conn) Context() context.Context {
+	if conn.ctx == nil {
+		return context.Background()
+	}
+	return conn.ctx
+}
+
+// Server returns the server the session belongs to.
+func (conn *Conn) Server() *Server {
+	return conn.server
+}
+
+// Reply sends a single line reply to the client. It is meant to be used by
+// custom commands registered with Server.RegisterCommand.
+func (conn *Conn) Reply(code int, message string) error {
+	_, err := conn.writeMessage(code, message)
+	return err
+}
+
+// ReplyMultiline sends a multiline reply to the client, the lines of message
+// being separated by "\r\n".
+func (conn *Conn) ReplyMultiline(code int, message string) error {
+	_, err := conn.writeMessageMultiline(code, message)
+	return err
+}
+
+// BuildPath returns the absolute path of a path given by the client,
+// relative to the current directory. See buildPath.
+func (conn *Conn) BuildPath(filename string) string {
+	return conn.buildPath(filename)
+}
+
+// SendData replies 150 and sends data to the client over the data
+// connection set up by PORT, PASV or their extended versions. The transfer
+// runs in the background and sends the final reply itself, data is closed
+// once it is finished.
+func (conn *Conn) SendData(data io.ReadCloser) {
+	conn.writeMessage(150, "Data transfer starting")
+	conn.sendOutofBandDataWriter(func(context.Context) (io.ReadCloser, error) {
+		return data, nil
+	})
+}
+
+// ReceiveData replies 150 and calls store with the data the client sends
+// over the data connection set up by PORT, PASV or their extended
+// versions. store returns the number of bytes it consumed, its context is
+// cancelled if the transfer is aborted. The transfer runs in the background
+// and sends the final reply itself.
+func (conn *Conn) ReceiveData(store func(context.Context, io.Reader) (int64, error)) {
+	conn.writeMessage(150, "Data transfer starting")
+	conn.receiveOutofBandData(store)
+}
+
+// AllowCommands restricts the commands of the session to the given ones,
+// on top of the restrictions of ServerOpts. It is meant to be called from
+// ServerOpts.OnLogin to configure the commands of each user.
+func (conn *Conn) AllowCommands(names ...string) {
+	conn.allowedCmds = commandSet(names)
+	if conn.allowedCmds == nil {
+		conn.allowedCmds = map[string]bool{}
+	}
+}
+
+// DisableCommands forbids the given commands for the rest of the session.
+// It is meant to be called from ServerOpts.OnLogin to configure the
+// commands of each user.
+func (conn *Conn) DisableCommands(names ...string) {
+	if conn.disabledCmds == nil {
+		conn.disabledCmds = map[string]bool{}
+	}
+	for name := range commandSet(names) {
+		conn.disabledCmds[name] = true
+	}
+}
+
+// alwaysAllowed are the commands that cannot be disabled, without which
+// a client could not log in or out.
+var alwaysAllowed = map[string]bool{"USER": true, "PASS": true, "QUIT": true}
+
+// commandAliases maps the aliases of commands to the command they run, so
+// that restricting a command restricts its aliases too.
+var commandAliases = map[string]string{
+	"XCUP":    "CDUP",
+	"XCWD":    "CWD",
+	"XMKD":    "MKD",
+	"XPWD":    "PWD",
+	"XRMD":    "RMD",
+	"XCRC":    "HASH",
+	"XMD5":    "HASH",
+	"XSHA1":   "HASH",
+	"XSHA256": "HASH",
+	"XSHA512": "HASH",
+}
+
+// canonicalCommand returns the upper case name of the command run by
+// command.
+func canonicalCommand(command string) string {
+	command = strings.ToUpper(command)
+	if name, ok := commandAliases[command]; ok {
+		return name
+	}
+	return command
+}
+
+// commandEnabled reports whether the client may use command, according to
+// ServerOpts and to the restrictions of the session. Aliases follow the
+// command they run.
+func (conn *Conn) commandEnabled(command string) bool {
+	command = canonicalCommand(command)
+	if alwaysAllowed[command] {
+		return true
+	}
+	if conn.server.allowed != nil && !conn.server.allowed[command] {
+		return false
+	}
+	if conn.server.disabled[command] {
+		return false
+	}
+	if conn.allowedCmds != nil && !conn.allowedCmds[command] {
+		return false
+	}
+	return !conn.disabledCmds[command]
 }
 
 func (conn *Conn) LoginUser() string {
@@ -57,19 +226,82 @@ func (conn *Conn) PublicIp() string {
 	return conn.server.PublicIp
 }
 
+// perm returns the Perm used to change file modes and ownership: the one
+// given in ServerOpts, or else the driver if it implements Perm. The
+// drivers restricting a user always refuse the changes.
+func (conn *Conn) perm() Perm {
+	switch driver := unwrapDriver(conn.driver).(type) {
+	case readOnlyDriver:
+		return driver
+	case dropBoxDriver:
+		return driver
+	}
+	if conn.server.Perm != nil {
+		return conn.server.Perm
+	}
+	if perm, ok := unwrapDriver(conn.driver).(Perm); ok && implements(conn.driver, "", isPerm) {
+		return perm
+	}
+	return nil
+}
+
+// logout ends the current login, if any, dropping the restrictions and the
+// drivers set up for the user.
+func (conn *Conn) logout() {
+	conn.user = ""
+	conn.allowedCmds = nil
+	conn.disabledCmds = nil
+	if conn.loginDriver != nil {
+		conn.driver = conn.loginDriver
+		conn.loginDriver = nil
+	}
+	conn.quota = nil
+}
+
+// enforceOpts wraps driver, the driver of a user who just logged in, with
+// the drivers implementing ServerOpts.AtomicUploads and ServerOpts.Quota.
+func (conn *Conn) enforceOpts(driver DriverV2) DriverV2 {
+	if conn.server.AtomicUploads {
+		driver = atomicDriver{driver}
+	}
+	if conn.server.Quota != nil {
+		conn.quota = &quotaDriver{driver, conn.server.Quota, conn}
+		driver = conn.quota
+	}
+	return driver
+}
+
+// accounted runs op, which changes the file at name through an optional
+// driver interface, charging the change to the quota of the user if any.
+// need is the number of bytes the file may grow by.
+func (conn *Conn) accounted(name string, need int64, op func() error) error {
+	if conn.quota == nil {
+		return op()
+	}
+	return conn.quota.account(conn.Context(), name, need, op)
+}
+
 func (conn *Conn) passiveListenIP() string {
 	var listenIP string
 	if len(conn.PublicIp()) > 0 {
 		listenIP = conn.PublicIp()
+		// tolerate a port after the address, as in "1.2.3.4:21"
+		if host, _, err := net.SplitHostPort(listenIP); err == nil {
+			listenIP = host
+		}
 	} else {
 		listenIP = conn.conn.LocalAddr().(*net.TCPAddr).IP.String()
 	}
+	return listenIP
+}
 
-	lastIdx := strings.LastIndex(listenIP, ":")
-	if lastIdx <= 0 {
-		return listenIP
+// controlAddressFamily returns the RFC 2428 network protocol number of the
+// control connection, 1 for IPv4 and 2 for IPv6.
+func (conn *Conn) controlAddressFamily() int {
+	if conn.conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+		return 1
 	}
-	return listenIP[:lastIdx]
+	return 2
 }
 
 func (conn *Conn) PassivePort() int {
@@ -102,6 +334,43 @@ func newSessionID() string {
 	return mdStr[0:20]
 }
 
+// status describes the state of the session for the STAT command.
+func (conn *Conn) status() string {
+	lines := []string{conn.server.Name + " status:"}
+	if conn.IsLogin() {
+		lines = append(lines, "Logged in as "+conn.user)
+	} else {
+		lines = append(lines, "Not logged in")
+	}
+	if addr := conn.conn.RemoteAddr(); addr != nil {
+		lines = append(lines, "Connected to "+addr.String())
+	}
+
+	transferType := "ASCII"
+	if conn.transferType == "I" {
+		transferType = "BINARY"
+	}
+	transferMode := "Stream"
+	if conn.transferMode == "Z" {
+		transferMode = "Deflate"
+	}
+	lines = append(lines, "TYPE: "+transferType+"; STRUcture: File; transfer MODE: "+transferMode)
+
+	if conn.tls {
+		lines = append(lines, "Control connection is protected by TLS")
+	} else {
+		lines = append(lines, "Control connection is plain text")
+	}
+	if t := conn.currentTransfer(); t != nil {
+		lines = append(lines, fmt.Sprintf("Transfer in progress, %d bytes transferred", t.Bytes()))
+	} else if conn.dataConn != nil {
+		lines = append(lines, "Data connection open")
+	} else {
+		lines = append(lines, "No data connection")
+	}
+	return strings.Join(lines, "\r\n ")
+}
+
 // Serve starts an endless loop that reads FTP commands from the client and
 // responds appropriately. terminated is a channel that will receive a true
 // message when the connection closes. This loop will be running inside a
@@ -136,6 +405,12 @@ func (conn *Conn) Serve() {
 func (conn *Conn) Close() {
 	conn.conn.Close()
 	conn.closed = true
+	if conn.cancel != nil {
+		conn.cancel()
+	}
+	if t := conn.currentTransfer(); t != nil {
+		t.abort()
+	}
 	if conn.dataConn != nil {
 		conn.dataConn.Close()
 		conn.dataConn = nil
@@ -160,21 +435,19 @@ func (conn *Conn) upgradeToTLS() error {
 func (conn *Conn) receiveLine(line string) {
 	command, param := conn.parseLine(line)
 	conn.logger.PrintCommand(conn.sessionID, command, param)
-	cmdObj := commands[strings.ToUpper(command)]
-	if cmdObj == nil {
-		conn.writeMessage(500, "Command not found")
-		return
-	}
-	if cmdObj.RequireParam() && param == "" {
-		conn.writeMessage(553, "action aborted, required param missing")
-	} else if cmdObj.RequireAuth() && conn.user == "" {
-		conn.writeMessage(530, "not logged in")
-	} else {
-		cmdObj.Execute(conn, param)
+	command = strings.ToUpper(command)
+	// Only ABOR and a plain STAT may run while a transfer is in progress,
+	// anything else waits for it to finish.
+	if command != "ABOR" && (command != "STAT" || param != "") {
+		conn.waitTransfer()
 	}
+	conn.server.handler()(conn, command, param)
 }
 
 func (conn *Conn) parseLine(line string) (string, string) {
+	// Clients may prefix urgent commands like ABOR with the telnet
+	// "Interrupt Process" and "Synch" sequences.
+	line = strings.TrimLeft(line, telnetIP+telnetSynch)
 	params := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
 	if len(params) == 1 {
 		return params[0], ""
@@ -184,6 +457,8 @@ func (conn *Conn) parseLine(line string) (string, string) {
 
 // writeMessage will send a standard FTP response back to the client.
 func (conn *Conn) writeMessage(code int, message string) (wrote int, err error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
 	conn.logger.PrintResponse(conn.sessionID, code, message)
 	line := fmt.Sprintf("%d %s\r\n", code, message)
 	wrote, err = conn.controlWriter.WriteString(line)
@@ -193,6 +468,8 @@ func (conn *Conn) writeMessage(code int, message string) (wrote int, err error)
 
 // writeMessage will send a standard FTP response back to the client.
 func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, err error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
 	conn.logger.PrintResponse(conn.sessionID, code, message)
 	line := fmt.Sprintf("%d-%s\r\n%d END\r\n", code, message, code)
 	wrote, err = conn.controlWriter.WriteString(line)
@@ -217,6 +494,8 @@ func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, er
 // The driver implementation is responsible for deciding how to treat this path.
 // Obviously they MUST NOT just read the path off disk. The probably want to
 // prefix the path with something to scope the users access to a sandbox.
+// DiskDriverFactory does so with an os.Root, which also keeps symbolic
+// links from leading out of the sandbox.
 func (conn *Conn) buildPath(filename string) (fullPath string) {
 	if len(filename) > 0 && filename[0:1] == "/" {
 		fullPath = filepath.Clean(filename)
@@ -231,30 +510,76 @@ func (conn *Conn) buildPath(filename string) (fullPath string) {
 }
 
 // sendOutofbandData will send a string to the client via the currently open
-// data socket. Assumes the socket is open and ready to be used.
+// data socket. The transfer runs in the background.
 func (conn *Conn) sendOutofbandData(data []byte) {
-	bytes := len(data)
-	if conn.dataConn != nil {
-		conn.dataConn.Write(data)
-		conn.dataConn.Close()
-		conn.dataConn = nil
-	}
-	message := "Closing data connection, sent " + strconv.Itoa(bytes) + " bytes"
-	conn.writeMessage(226, message)
+	conn.startTransfer(func(t *transfer) {
+		t.Write(data)
+		t.closeWrite()
+		if t.aborted() {
+			conn.writeMessage(426, "Connection closed; transfer aborted")
+			return
+		}
+		message := "Closing data connection, sent " + strconv.Itoa(int(t.Bytes())) + " bytes"
+		conn.writeMessage(226, message)
+	})
 }
 
-func (conn *Conn) sendOutofBandDataWriter(data io.ReadCloser) error {
-	conn.lastFilePos = 0
-	bytes, err := io.Copy(conn.dataConn, data)
-	if err != nil {
-		conn.dataConn.Close()
-		conn.dataConn = nil
-		return err
-	}
-	message := "Closing data connection, sent " + strconv.Itoa(int(bytes)) + " bytes"
-	conn.writeMessage(226, message)
-	conn.dataConn.Close()
-	conn.dataConn = nil
+// sendOutofBandDataWriter copies the data returned by open to the client via
+// the currently open data socket and closes it, translating line endings in
+// ASCII mode. The transfer runs in the background, open is called from it
+// with a context cancelled if the transfer is aborted.
+func (conn *Conn) sendOutofBandDataWriter(open func(context.Context) (io.ReadCloser, error)) {
+	ascii := conn.transferType == "A"
+	conn.startTransfer(func(t *transfer) {
+		data, err := open(t.ctx)
+		if err != nil {
+			t.closeWrite()
+			if t.aborted() {
+				conn.writeMessage(426, "Connection closed; transfer aborted")
+			} else {
+				conn.replyError(550, err)
+			}
+			return
+		}
+		defer data.Close()
+		var src io.Reader = data
+		if ascii {
+			src = newASCIIEncoder(data)
+		}
+		bytes, err := io.Copy(t, src)
+		if cerr := t.closeWrite(); err == nil {
+			err = cerr
+		}
+		if t.aborted() {
+			conn.writeMessage(426, "Connection closed; transfer aborted")
+		} else if err != nil {
+			conn.replyError(451, err)
+		} else {
+			message := "Closing data connection, sent " + strconv.Itoa(int(bytes)) + " bytes"
+			conn.writeMessage(226, message)
+		}
+	})
+}
 
-	return nil
+// receiveOutofBandData hands the data sent by the client via the currently
+// open data socket to store, translating line endings in ASCII mode. The
+// transfer runs in the background.
+func (conn *Conn) receiveOutofBandData(store func(context.Context, io.Reader) (int64, error)) {
+	ascii := conn.transferType == "A"
+	conn.startTransfer(func(t *transfer) {
+		var src io.Reader = t
+		if ascii {
+			src = newASCIIDecoder(t)
+		}
+		bytes, err := store(t.ctx, src)
+		t.close()
+		if t.aborted() {
+			conn.writeMessage(426, "Connection closed; transfer aborted")
+		} else if err == nil {
+			msg := "OK, received " + strconv.Itoa(int(bytes)) + " bytes"
+			conn.writeMessage(226, msg)
+		} else {
+			conn.replyError(451, err)
+		}
+	})
 }
@@ -5,7 +5,11 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -90,4 +94,153 @@ func TestPassiveListenIP(t *testing.T) {
 	if c.passiveListenIP() != "1.1.1.1" {
 		t.Fatalf("Expected passive listen IP to be 1.1.1.1 but got %s", c.passiveListenIP())
 	}
+
+	c = &Conn{
+		conn: mockConn{
+			ip: net.ParseIP("2001:db8::1"),
+		},
+		server: &Server{
+			ServerOpts: &ServerOpts{},
+		},
+	}
+	if c.passiveListenIP() != "2001:db8::1" {
+		t.Fatalf("Expected passive listen IP to be 2001:db8::1 but got %s", c.passiveListenIP())
+	}
+
+	c.server.PublicIp = "1.1.1.1:21"
+	if c.passiveListenIP() != "1.1.1.1" {
+		t.Fatalf("Expected passive listen IP to be 1.1.1.1 but got %s", c.passiveListenIP())
+	}
+}
+
+func TestPassiveIPv6(t *testing.T) {
+	var buf bytes.Buffer
+	c := &Conn{
+		conn: mockConn{
+			ip: net.ParseIP("2001:db8::1"),
+		},
+		user:          "admin",
+		controlWriter: bufio.NewWriter(&buf),
+		logger:        &DiscardLogger{},
+		server: &Server{
+			ServerOpts: &ServerOpts{},
+		},
+	}
+
+	var replyTests = []struct {
+		command string
+		param   string
+		reply   string
+	}{
+		{"PASV", "", "522 "},
+		{"EPSV", "1", "522 Network protocol not supported, use (2)"},
+		{"EPSV", "3", "522 "},
+		{"EPRT", "|1|2001:db8::2|5282|", "501 "},
+		{"EPRT", "|2|10.0.0.1|5282|", "501 "},
+		{"EPRT", "|3|10.0.0.1|5282|", "522 "},
+		{"EPRT", "|2|2001:db8::2|", "501 "},
+		{"EPSV", "ALL", "200 "},
+		{"PASV", "", "503 "},
+		{"PORT", "10,0,0,1,4,1", "503 "},
+		{"EPRT", "|2|2001:db8::2|5282|", "503 "},
+	}
+	for _, tt := range replyTests {
+		buf.Reset()
+		commands[tt.command].Execute(c, tt.param)
+		if !strings.HasPrefix(buf.String(), tt.reply) {
+			t.Errorf("%s %s: expected reply %q, got %q", tt.command, tt.param, tt.reply, buf.String())
+		}
+	}
+}
+
+func TestLprt(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	valid := fmt.Sprintf("4,4,127,0,0,1,2,%d,%d", port/256, port%256)
+
+	var buf bytes.Buffer
+	c := &Conn{
+		conn:          mockConn{},
+		user:          "admin",
+		controlWriter: bufio.NewWriter(&buf),
+		logger:        &DiscardLogger{},
+		server: &Server{
+			ServerOpts: &ServerOpts{},
+		},
+	}
+	defer c.Close()
+
+	var lprtTests = []struct {
+		param string
+		reply string
+	}{
+		{"4", "501 "},
+		{"x,4", "501 "},
+		{"6,16", "522 "},
+		{"4,16", "522 "},
+		{"4,4,127,0,0,1", "501 "},
+		{"4,4,127,0,0,1,2,0", "501 "},
+		{"4,4,127,0,0,1,1,21", "501 "},
+		{"4,4,127,0,0,1,2,300,21", "501 "},
+		{valid, "200 "},
+		{valid, "200 "},
+	}
+	for _, tt := range lprtTests {
+		buf.Reset()
+		commandLprt{}.Execute(c, tt.param)
+		if !strings.HasPrefix(buf.String(), tt.reply) {
+			t.Errorf("LPRT %s: expected reply %q, got %q", tt.param, tt.reply, buf.String())
+		}
+	}
+}
+
+func TestConnStatus(t *testing.T) {
+	var buf bytes.Buffer
+	c := &Conn{
+		conn:          mockConn{},
+		user:          "admin",
+		transferType:  "I",
+		controlWriter: bufio.NewWriter(&buf),
+		logger:        &DiscardLogger{},
+		server: &Server{
+			ServerOpts: &ServerOpts{Name: "test ftpd"},
+		},
+	}
+
+	commandStat{}.Execute(c, "")
+	expected := "211-test ftpd status:\r\n" +
+		" Logged in as admin\r\n" +
+		" TYPE: BINARY; STRUcture: File; transfer MODE: Stream\r\n" +
+		" Control connection is plain text\r\n" +
+		" No data connection\r\n" +
+		"211 END\r\n"
+	if buf.String() != expected {
+		t.Errorf("got %q, want %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	c.user = ""
+	commandStat{}.Execute(c, "/")
+	if !strings.HasPrefix(buf.String(), "530 ") {
+		t.Errorf("expected STAT with a path to require login, got %q", buf.String())
+	}
+
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	if _, err := memDriver.PutFile("/a.txt", strings.NewReader("a"), false); err != nil {
+		t.Fatal(err)
+	}
+	c.user = "admin"
+	c.driver = AdaptDriver(memDriver)
+	for param, reply := range map[string]string{"/": "212-", "/a.txt": "213-"} {
+		buf.Reset()
+		commandStat{}.Execute(c, param)
+		if !strings.HasPrefix(buf.String(), reply) {
+			t.Errorf("STAT %s: expected reply %q, got %q", param, reply, buf.String())
+		}
+	}
 }
@@ -0,0 +1,458 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.25
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskDriverFactory creates drivers serving the files of a local
+// directory. All the accesses go through an os.Root, so that neither ".."
+// nor a symbolic link can reach a file outside of the directory.
+type DiskDriverFactory struct {
+	// The directory served to the clients. Mandatory.
+	RootPath string
+
+	// If true each user is served the subdirectory of RootPath named after
+	// them, which is created on their first login.
+	PerUser bool
+
+	// The permissions of the files and directories created by the clients,
+	// before the umask. Default to 0644 and 0755.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// If true clients may give files to other users and groups with SITE
+	// CHOWN and CHGRP, which are refused by default.
+	AllowChown bool
+}
+
+// NewDriver returns a driver for a new session.
+func (factory *DiskDriverFactory) NewDriver() (Driver, error) {
+	root, err := os.OpenRoot(factory.RootPath)
+	if err != nil {
+		return nil, err
+	}
+	driver := &DiskDriver{
+		root:       root,
+		perUser:    factory.PerUser,
+		fileMode:   factory.FileMode,
+		dirMode:    factory.DirMode,
+		allowChown: factory.AllowChown,
+	}
+	if driver.fileMode == 0 {
+		driver.fileMode = 0644
+	}
+	if driver.dirMode == 0 {
+		driver.dirMode = 0755
+	}
+	return driver, nil
+}
+
+// DiskDriver is the Driver of a session on the directory of a
+// DiskDriverFactory. It also implements Perm, TimesDriver, RestartDriver,
+// SymlinkDriver, CopyDriver, TruncateDriver and, on most Unix systems,
+// StatFSDriver.
+type DiskDriver struct {
+	conn       *Conn
+	root       *os.Root
+	perUser    bool
+	fileMode   os.FileMode
+	dirMode    os.FileMode
+	allowChown bool
+
+	lock     sync.Mutex // protects userRoot and user
+	userRoot *os.Root
+	user     string
+}
+
+// Init closes the roots of the driver once the session ends.
+func (driver *DiskDriver) Init(conn *Conn) {
+	driver.conn = conn
+	context.AfterFunc(conn.Context(), func() {
+		driver.lock.Lock()
+		defer driver.lock.Unlock()
+		if driver.userRoot != nil {
+			driver.userRoot.Close()
+			driver.userRoot = nil
+		}
+		driver.root.Close()
+	})
+}
+
+// currentRoot returns the root of the logged in user.
+func (driver *DiskDriver) currentRoot() (*os.Root, error) {
+	if !driver.perUser {
+		return driver.root, nil
+	}
+	user := ""
+	if driver.conn != nil {
+		user = driver.conn.LoginUser()
+	}
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, `/\`) {
+		return nil, fmt.Errorf("%q: %w", user, ErrPermission)
+	}
+
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if driver.userRoot != nil && driver.user == user {
+		return driver.userRoot, nil
+	}
+	if driver.userRoot != nil {
+		driver.userRoot.Close()
+		driver.userRoot = nil
+	}
+	err := driver.root.Mkdir(user, driver.dirMode)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	root, err := driver.root.OpenRoot(user)
+	if err != nil {
+		return nil, err
+	}
+	driver.userRoot, driver.user = root, user
+	return root, nil
+}
+
+// diskFileInfo adds the names of the owner and group to an os.FileInfo.
+type diskFileInfo struct {
+	os.FileInfo
+}
+
+func (f diskFileInfo) Owner() string {
+	return fileOwner(f.FileInfo)
+}
+
+func (f diskFileInfo) Group() string {
+	return fileGroup(f.FileInfo)
+}
+
+func (driver *DiskDriver) Stat(name string) (FileInfo, error) {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return nil, err
+	}
+	info, err := root.Stat(rootName(name))
+	if err != nil {
+		return nil, err
+	}
+	return diskFileInfo{info}, nil
+}
+
+func (driver *DiskDriver) ChangeDir(name string) error {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", name)
+	}
+	return nil
+}
+
+func (driver *DiskDriver) ListDir(name string, callback func(FileInfo) error) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	dir, err := root.Open(rootName(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		if err := callback(diskFileInfo{info}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *DiskDriver) DeleteDir(name string) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	info, err := root.Lstat(rootName(name))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", name)
+	}
+	return root.Remove(rootName(name))
+}
+
+func (driver *DiskDriver) DeleteFile(name string) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	info, err := root.Lstat(rootName(name))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: is a directory", name)
+	}
+	return root.Remove(rootName(name))
+}
+
+func (driver *DiskDriver) Rename(fromPath string, toPath string) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	return root.Rename(rootName(fromPath), rootName(toPath))
+}
+
+func (driver *DiskDriver) MakeDir(name string) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	return root.Mkdir(rootName(name), driver.dirMode)
+}
+
+func (driver *DiskDriver) GetFile(name string, offset int64) (int64, io.ReadCloser, error) {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return 0, nil, err
+	}
+	f, err := root.Open(rootName(name))
+	if err != nil {
+		return 0, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return 0, nil, fmt.Errorf("%s: is a directory", name)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	return info.Size() - offset, f, nil
+}
+
+func (driver *DiskDriver) PutFile(name string, data io.Reader, appendData bool) (int64, error) {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return 0, err
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendData {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := root.OpenFile(rootName(name), flag, driver.fileMode)
+	if err != nil {
+		return 0, err
+	}
+	bytes, err := io.Copy(f, data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return bytes, err
+}
+
+// PutFileAt truncates a file at offset then writes data from there.
+func (driver *DiskDriver) PutFileAt(name string, offset int64, data io.Reader) (int64, error) {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return 0, err
+	}
+	f, err := root.OpenFile(rootName(name), os.O_WRONLY, driver.fileMode)
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err == nil && (offset < 0 || offset > info.Size()) {
+		err = fmt.Errorf("%s: invalid offset %d", name, offset)
+	}
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	bytes, err := io.Copy(f, data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return bytes, err
+}
+
+// Symlink creates a link to target, which must be relative: an absolute
+// target would be resolved outside of the root.
+func (driver *DiskDriver) Symlink(target string, name string) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+		return fmt.Errorf("%s: absolute link target: %w", target, ErrPermission)
+	}
+	return root.Symlink(target, rootName(name))
+}
+
+func (driver *DiskDriver) Readlink(name string) (string, error) {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return "", err
+	}
+	return root.Readlink(rootName(name))
+}
+
+func (driver *DiskDriver) CopyFile(fromPath string, toPath string) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	src, err := root.Open(rootName(fromPath))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: is a directory", fromPath)
+	}
+	// opening the destination would truncate the source
+	if dstInfo, err := root.Stat(rootName(toPath)); err == nil && os.SameFile(info, dstInfo) {
+		return fmt.Errorf("%s: same file as %s", toPath, fromPath)
+	}
+	dst, err := root.OpenFile(rootName(toPath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, driver.fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (driver *DiskDriver) Truncate(name string, size int64) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	f, err := root.OpenFile(rootName(name), os.O_WRONLY, driver.fileMode)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (driver *DiskDriver) GetOwner(name string) (string, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return info.Owner(), nil
+}
+
+func (driver *DiskDriver) GetGroup(name string) (string, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return info.Group(), nil
+}
+
+func (driver *DiskDriver) GetMode(name string) (os.FileMode, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Mode(), nil
+}
+
+func (driver *DiskDriver) ChOwner(name string, owner string) error {
+	if !driver.allowChown {
+		return fmt.Errorf("%s: changing the owner: %w", name, ErrPermission)
+	}
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	uid, err := lookupUID(owner)
+	if err != nil {
+		return err
+	}
+	return root.Chown(rootName(name), uid, -1)
+}
+
+func (driver *DiskDriver) ChGroup(name string, group string) error {
+	if !driver.allowChown {
+		return fmt.Errorf("%s: changing the group: %w", name, ErrPermission)
+	}
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	gid, err := lookupGID(group)
+	if err != nil {
+		return err
+	}
+	return root.Chown(rootName(name), -1, gid)
+}
+
+// ChMode changes the permission bits of a file, the setuid, setgid and
+// sticky bits are never set.
+func (driver *DiskDriver) ChMode(name string, mode os.FileMode) error {
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	return root.Chmod(rootName(name), mode&os.ModePerm)
+}
+
+// SetTimes sets the access and modification times of a file, the creation
+// time cannot be changed and is refused with ErrNotSupported.
+func (driver *DiskDriver) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	if !ctime.IsZero() {
+		return fmt.Errorf("%s: creation time: %w", name, ErrNotSupported)
+	}
+	root, err := driver.currentRoot()
+	if err != nil {
+		return err
+	}
+	return root.Chtimes(rootName(name), atime, mtime)
+}
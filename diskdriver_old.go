@@ -0,0 +1,42 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.25
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+// errDiskDriverGo is returned by DiskDriverFactory when the package is built
+// with a Go release without the os.Root methods it relies on.
+var errDiskDriverGo = errors.New("DiskDriverFactory requires Go 1.25 or later")
+
+// DiskDriverFactory creates drivers serving the files of a local
+// directory. It requires Go 1.25, with older releases NewDriver always
+// fails.
+type DiskDriverFactory struct {
+	// The directory served to the clients. Mandatory.
+	RootPath string
+
+	// If true each user is served the subdirectory of RootPath named after
+	// them, which is created on their first login.
+	PerUser bool
+
+	// The permissions of the files and directories created by the clients,
+	// before the umask. Default to 0644 and 0755.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// If true clients may give files to other users and groups with SITE
+	// CHOWN and CHGRP, which are refused by default.
+	AllowChown bool
+}
+
+// NewDriver returns an error, DiskDriver is not available before Go 1.25.
+func (factory *DiskDriverFactory) NewDriver() (Driver, error) {
+	return nil, errDiskDriverGo
+}
@@ -0,0 +1,30 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoOwners = errors.New("file owners are not supported on this system")
+
+func fileOwner(info os.FileInfo) string {
+	return ""
+}
+
+func fileGroup(info os.FileInfo) string {
+	return ""
+}
+
+func lookupUID(name string) (int, error) {
+	return 0, errNoOwners
+}
+
+func lookupGID(name string) (int, error) {
+	return 0, errNoOwners
+}
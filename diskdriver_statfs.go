@@ -0,0 +1,21 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.25 && (linux || darwin || freebsd)
+
+package server
+
+import (
+	"syscall"
+)
+
+// StatFS returns the space available to unprivileged users on the file
+// system of the root.
+func (driver *DiskDriver) StatFS(name string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(driver.root.Name(), &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.25 && unix
+
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func newDiskDriver(t *testing.T, factory *DiskDriverFactory, login string) *DiskDriver {
+	t.Helper()
+	driver, err := factory.NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	driver.Init(&Conn{user: login, ctx: ctx, cancel: cancel})
+	return driver.(*DiskDriver)
+}
+
+func TestDiskDriverSandbox(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Mkdir(filepath.Join(dir, "root"), 0755)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "root", "link"))
+	os.Symlink(outside, filepath.Join(dir, "root", "linkdir"))
+
+	driver := newDiskDriver(t, &DiskDriverFactory{RootPath: filepath.Join(dir, "root")}, "admin")
+	for _, name := range []string{"/link", "/linkdir/secret", "/../../" + filepath.Base(outside) + "/secret"} {
+		if _, _, err := driver.GetFile(name, 0); err == nil {
+			t.Errorf("GetFile(%s) escaped the root", name)
+		}
+	}
+	if _, err := driver.PutFile("/linkdir/new", strings.NewReader("x"), false); err == nil {
+		t.Error("PutFile through a symbolic link escaped the root")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); err == nil {
+		t.Error("file created outside of the root")
+	}
+}
+
+func TestDiskDriverFiles(t *testing.T) {
+	dir := t.TempDir()
+	factory := &DiskDriverFactory{RootPath: dir, PerUser: true, FileMode: 0600, DirMode: 0700}
+	driver := newDiskDriver(t, factory, "alice")
+
+	if _, err := driver.PutFile("/a.txt", strings.NewReader("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.PutFile("/a.txt", strings.NewReader(" world"), true); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "alice", "a.txt"))
+	if err != nil || string(content) != "hello world" {
+		t.Fatalf("got %q, %v in the root of alice", content, err)
+	}
+
+	size, data, err := driver.GetFile("/a.txt", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	n, _ := data.Read(buf)
+	data.Close()
+	if size != 5 || string(buf[:n]) != "world" {
+		t.Errorf("got %d %q from offset 6", size, buf[:n])
+	}
+
+	if _, err := driver.PutFileAt("/a.txt", 12, strings.NewReader("!")); err == nil {
+		t.Error("expected an error resuming past the end")
+	}
+	if _, err := driver.PutFileAt("/a.txt", 2, strings.NewReader("y")); err != nil {
+		t.Fatal(err)
+	}
+	content, err = os.ReadFile(filepath.Join(dir, "alice", "a.txt"))
+	if err != nil || string(content) != "hey" {
+		t.Errorf("got %q, %v after resuming at offset 2", content, err)
+	}
+
+	if err := driver.MakeDir("/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Rename("/a.txt", "/sub/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	driver.ListDir("/sub", func(f FileInfo) error {
+		names = append(names, f.Name())
+		return nil
+	})
+	if strings.Join(names, " ") != "b.txt" {
+		t.Errorf("got %v in /sub", names)
+	}
+
+	mask := os.FileMode(syscall.Umask(0))
+	syscall.Umask(int(mask))
+	if info, _ := driver.Stat("/sub"); info.Mode().Perm() != 0700&^mask {
+		t.Errorf("got mode %v for a new directory", info.Mode())
+	}
+	info, err := driver.Stat("/sub/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600&^mask {
+		t.Errorf("got mode %v for a new file", info.Mode())
+	}
+	if current, err := user.Current(); err == nil && info.Owner() != current.Username {
+		t.Errorf("got owner %q, want %q", info.Owner(), current.Username)
+	}
+
+	// no special bits nor ownership changes unless allowed
+	if err := driver.ChMode("/sub/b.txt", 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := driver.Stat("/sub/b.txt"); info.Mode()&^os.ModeType != 0755 {
+		t.Errorf("got mode %v after ChMode", info.Mode())
+	}
+	if err := driver.ChOwner("/sub/b.txt", "root"); !errors.Is(err, ErrPermission) {
+		t.Errorf("expected ErrPermission from ChOwner, got %v", err)
+	}
+	if err := driver.ChGroup("/sub/b.txt", "root"); !errors.Is(err, ErrPermission) {
+		t.Errorf("expected ErrPermission from ChGroup, got %v", err)
+	}
+
+	other := newDiskDriver(t, factory, "bob")
+	if _, err := other.Stat("/sub/b.txt"); err == nil {
+		t.Error("bob can see the files of alice")
+	}
+
+	if err := driver.DeleteDir("/sub"); err == nil {
+		t.Error("expected an error deleting a directory that is not empty")
+	}
+	if err := driver.DeleteFile("/sub/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.DeleteDir("/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newDiskDriver(t, factory, "..").Stat("/"); err == nil {
+		t.Error("expected an error for user ..")
+	}
+}
+
+func TestDiskDriverCapabilities(t *testing.T) {
+	dir := t.TempDir()
+	driver := newDiskDriver(t, &DiskDriverFactory{RootPath: dir}, "admin")
+	if _, err := driver.PutFile("/a.txt", strings.NewReader("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.CopyFile("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Truncate("/b.txt", 2); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "b.txt"))
+	if err != nil || string(content) != "he" {
+		t.Errorf("got %q, %v after copying and truncating", content, err)
+	}
+
+	if err := driver.Symlink("a.txt", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := driver.Readlink("/link"); err != nil || target != "a.txt" {
+		t.Errorf("Readlink: got %q, %v", target, err)
+	}
+	if err := driver.Symlink("/etc/passwd", "/abs"); err == nil {
+		t.Error("expected an error for an absolute target")
+	}
+
+	for _, name := range []string{"/a.txt", "/link"} {
+		if err := driver.CopyFile("/a.txt", name); err == nil {
+			t.Errorf("expected an error copying /a.txt to %s", name)
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(content) != "hello" {
+		t.Errorf("got %q, %v after copying a file onto itself", content, err)
+	}
+
+	if statfs, ok := interface{}(driver).(StatFSDriver); ok {
+		if free, err := statfs.StatFS("/"); err != nil || free <= 0 {
+			t.Errorf("StatFS: got %d, %v", free, err)
+		}
+	}
+}
@@ -9,6 +9,8 @@ http://www.faqs.org/rfcs/rfc2389.html
 http://www.faqs.org/rfcs/rfc959.html
 
 http://tools.ietf.org/html/rfc2428
+
+http://tools.ietf.org/html/rfc3659
 */
 
 package server
@@ -4,7 +4,10 @@
 
 package server
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // DriverFactory is a driver factory to create driver. For each client that connects to the server, a new FTPDriver is required.
 // Create an implementation if this interface and provide it to FTPServer.
@@ -15,6 +18,9 @@ type DriverFactory interface {
 // Driver is an interface that you will create an implementation that speaks to your
 // chosen persistence layer. graval will create a new instance of your
 // driver for each client that connects and delegate to it as required.
+//
+// Errors should be or wrap ErrNotFound, ErrPermission and the other errors
+// of this package, so that clients get the right reply code.
 type Driver interface {
 	// Init init
 	Init(*Conn)
@@ -59,3 +65,93 @@ type Driver interface {
 	// returns - the number of bytes writen and the first error encountered while writing, if any.
 	PutFile(string, io.Reader, bool) (int64, error)
 }
+
+// HashDriver is an optional interface a Driver may implement when the
+// backend already knows the checksums of its files. The server then uses it
+// to answer HASH, XCRC, XMD5 and XSHA* for whole files instead of reading
+// the data through GetFile.
+type HashDriver interface {
+	// params  - path, algorithm (one of the Hash* constants)
+	// returns - the hex encoded checksum of the file or any error encountered
+	Hash(string, string) (string, error)
+}
+
+// TimesDriver is an optional interface a Driver may implement to let
+// clients change file timestamps with MFMT and SITE UTIME, and with MFCT
+// when it also implements CreationTimeDriver.
+type TimesDriver interface {
+	// params  - path, access time, modification time, creation time
+	// returns - nil if the times were changed or any error encountered.
+	//           A zero time means that timestamp should be left unchanged.
+	SetTimes(string, time.Time, time.Time, time.Time) error
+}
+
+// CreationTimeDriver is an optional interface a TimesDriver may implement
+// when SetTimes can change the creation time of files. MFCT is only offered
+// when it does, other TimesDriver implementations should fail with
+// ErrNotSupported when given a creation time.
+type CreationTimeDriver interface {
+	// returns - true if SetTimes applies the creation time it is given
+	CreationTimeSupported() bool
+}
+
+// RestartDriver is an optional interface a Driver may implement to resume
+// interrupted uploads: a STOR following REST then writes the data from the
+// offset given to REST. Without it such a STOR is only accepted when the
+// offset is the size of the file, the data being appended.
+type RestartDriver interface {
+	// params  - destination path, offset, an io.Reader containing the file data
+	// returns - the number of bytes written and the first error encountered while writing, if any.
+	//           The file is truncated at offset before the data is written,
+	//           an offset beyond the end of the file is an error.
+	PutFileAt(string, int64, io.Reader) (int64, error)
+}
+
+// SymlinkDriver is an optional interface a Driver may implement to let
+// clients create and read symbolic links with SITE SYMLINK and SITE
+// READLINK.
+type SymlinkDriver interface {
+	// params  - target, path of the new link
+	// returns - nil if the link was created or any error encountered
+	Symlink(string, string) error
+
+	// params  - path of a link
+	// returns - the target of the link or any error encountered
+	Readlink(string) (string, error)
+}
+
+// CopyDriver is an optional interface a Driver may implement to copy files
+// on the server, without sending the data through the client, with SITE
+// CPFR and SITE CPTO.
+type CopyDriver interface {
+	// params  - source path, destination path
+	// returns - nil if the file was copied or any error encountered
+	CopyFile(string, string) error
+}
+
+// TruncateDriver is an optional interface a Driver may implement to
+// shorten files. Without RestartDriver, a STOR following REST then
+// truncates the file at the offset before appending the data.
+type TruncateDriver interface {
+	// params  - path, size
+	// returns - nil if the file was truncated or any error encountered
+	Truncate(string, int64) error
+}
+
+// AllocateDriver is an optional interface a Driver may implement to
+// reserve the storage announced by ALLO before the upload that follows.
+type AllocateDriver interface {
+	// params  - path of the upload, size in bytes
+	// returns - nil if the storage was reserved or any error encountered.
+	//           PutFile is called afterwards as usual.
+	Allocate(string, int64) error
+}
+
+// StatFSDriver is an optional interface a Driver may implement to tell
+// clients the free storage with AVBL.
+type StatFSDriver interface {
+	// params  - path
+	// returns - the number of bytes available to store files at path or
+	//           any error encountered
+	StatFS(string) (int64, error)
+}
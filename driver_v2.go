@@ -0,0 +1,246 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"io"
+)
+
+// DriverFactoryV2 creates a DriverV2 for each client that connects. Use it
+// instead of a DriverFactory with ServerOpts.FactoryV2.
+type DriverFactoryV2 interface {
+	NewDriverV2() (DriverV2, error)
+}
+
+// DriverV2 is the version of Driver whose methods take a context. The
+// context is cancelled when the session ends, when the server is shut down
+// or, for PutFile, when the transfer is aborted, so that a backend can stop
+// working for a client that is gone.
+//
+// The optional interfaces such as HashDriver and TimesDriver and the Perm
+// interface may be implemented by a DriverV2 as well.
+type DriverV2 interface {
+	// Init init
+	Init(*Conn)
+
+	// params  - context, a file path
+	// returns - the file info or an error if the file doesn't exist or the
+	//           user lacks permissions
+	Stat(context.Context, string) (FileInfo, error)
+
+	// params  - context, path
+	// returns - nil if the current user is permitted to change to the
+	//           requested path
+	ChangeDir(context.Context, string) error
+
+	// params  - context, path, function on file or subdir found
+	// returns - error
+	ListDir(context.Context, string, func(FileInfo) error) error
+
+	// params  - context, path
+	// returns - nil if the directory was deleted or any error encountered
+	DeleteDir(context.Context, string) error
+
+	// params  - context, path
+	// returns - nil if the file was deleted or any error encountered
+	DeleteFile(context.Context, string) error
+
+	// params  - context, from_path, to_path
+	// returns - nil if the file was renamed or any error encountered
+	Rename(context.Context, string, string) error
+
+	// params  - context, path
+	// returns - nil if the new directory was created or any error encountered
+	MakeDir(context.Context, string) error
+
+	// params  - context, path, offset
+	// returns - the size of the data and a reader of the file data to send
+	//           to the client. The reader is closed once the transfer ends.
+	GetFile(context.Context, string, int64) (int64, io.ReadCloser, error)
+
+	// params  - context, destination path, an io.Reader containing the file
+	//           data, whether to append to the file
+	// returns - the number of bytes writen and the first error encountered
+	//           while writing, if any.
+	PutFile(context.Context, string, io.Reader, bool) (int64, error)
+}
+
+// AdaptDriver returns a DriverV2 calling driver. The context is only
+// checked before each call, driver itself cannot be interrupted.
+func AdaptDriver(driver Driver) DriverV2 {
+	return driverAdapter{driver}
+}
+
+// driverAdapter is the DriverV2 returned by AdaptDriver.
+type driverAdapter struct {
+	driver Driver
+}
+
+func (a driverAdapter) Init(conn *Conn) {
+	a.driver.Init(conn)
+}
+
+func (a driverAdapter) Stat(ctx context.Context, path string) (FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.driver.Stat(path)
+}
+
+func (a driverAdapter) ChangeDir(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.driver.ChangeDir(path)
+}
+
+func (a driverAdapter) ListDir(ctx context.Context, path string, callback func(FileInfo) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.driver.ListDir(path, func(f FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return callback(f)
+	})
+}
+
+func (a driverAdapter) DeleteDir(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.driver.DeleteDir(path)
+}
+
+func (a driverAdapter) DeleteFile(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.driver.DeleteFile(path)
+}
+
+func (a driverAdapter) Rename(ctx context.Context, fromPath string, toPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.driver.Rename(fromPath, toPath)
+}
+
+func (a driverAdapter) MakeDir(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.driver.MakeDir(path)
+}
+
+func (a driverAdapter) GetFile(ctx context.Context, path string, offset int64) (int64, io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	return a.driver.GetFile(path, offset)
+}
+
+func (a driverAdapter) PutFile(ctx context.Context, path string, data io.Reader, appendData bool) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.driver.PutFile(path, data, appendData)
+}
+
+// driverFactoryAdapter creates DriverV2 instances from a DriverFactory.
+type driverFactoryAdapter struct {
+	factory DriverFactory
+}
+
+func (a driverFactoryAdapter) NewDriverV2() (DriverV2, error) {
+	driver, err := a.factory.NewDriver()
+	if err != nil {
+		return nil, err
+	}
+	return AdaptDriver(driver), nil
+}
+
+// unwrapDriver returns the Driver adapted by AdaptDriver, or driver itself,
+// so that the optional interfaces can be looked up on it. The quota
+// accounting and atomic uploads are skipped, they do not hide the
+// interfaces of the driver.
+func unwrapDriver(driver DriverV2) interface{} {
+	for {
+		switch d := driver.(type) {
+		case *quotaDriver:
+			driver = d.DriverV2
+		case atomicDriver:
+			driver = d.DriverV2
+		case driverAdapter:
+			return d.driver
+		default:
+			return driver
+		}
+	}
+}
+
+// implements reports whether the optional interface checked by probe can be
+// used on the file name of driver, or if name is empty on any of its files.
+// A MountDriver implements them all, but only as far as its mounts do.
+func implements(driver DriverV2, name string, probe func(interface{}) bool) bool {
+	d := unwrapDriver(driver)
+	if m, ok := d.(*MountDriver); ok {
+		return m.implements(name, probe)
+	}
+	return probe(d)
+}
+
+func isPerm(d interface{}) bool {
+	_, ok := d.(Perm)
+	return ok
+}
+
+func isTimesDriver(d interface{}) bool {
+	_, ok := d.(TimesDriver)
+	return ok
+}
+
+func isRestartDriver(d interface{}) bool {
+	_, ok := d.(RestartDriver)
+	return ok
+}
+
+func isTruncateDriver(d interface{}) bool {
+	_, ok := d.(TruncateDriver)
+	return ok
+}
+
+// putFileAtFunc stores data at an offset of a file, see RestartDriver.
+type putFileAtFunc func(ctx context.Context, name string, offset int64, data io.Reader) (int64, error)
+
+// restarter returns the function resuming uploads of name with the
+// RestartDriver of driver, or nil if it has none for name. Unlike the other optional interfaces
+// the quota is enforced on it, and it writes in place even with atomic
+// uploads.
+func restarter(driver DriverV2, name string) putFileAtFunc {
+	switch d := driver.(type) {
+	case *quotaDriver:
+		if putFileAt := restarter(d.DriverV2, name); putFileAt != nil {
+			return func(ctx context.Context, name string, offset int64, data io.Reader) (int64, error) {
+				return d.putFileAt(ctx, putFileAt, name, offset, data)
+			}
+		}
+		return nil
+	case atomicDriver:
+		return restarter(d.DriverV2, name)
+	}
+	r, ok := unwrapDriver(driver).(RestartDriver)
+	if !ok || !implements(driver, name, isRestartDriver) {
+		return nil
+	}
+	return func(ctx context.Context, name string, offset int64, data io.Reader) (int64, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return r.PutFileAt(name, offset, data)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingDriver blocks in Stat and GetFile until its context is
+// cancelled.
+type blockingDriver struct {
+	DriverV2
+	called chan struct{}
+	result chan error
+}
+
+func (d blockingDriver) Stat(ctx context.Context, path string) (FileInfo, error) {
+	close(d.called)
+	<-ctx.Done()
+	d.result <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (d blockingDriver) GetFile(ctx context.Context, path string, offset int64) (int64, io.ReadCloser, error) {
+	_, err := d.Stat(ctx, path)
+	return 0, nil, err
+}
+
+func TestDriverV2Cancel(t *testing.T) {
+	driver := blockingDriver{called: make(chan struct{}), result: make(chan error, 1)}
+	c, _ := newTestConn(nil)
+	c.driver = driver
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	done := sendCommand(c, "MLST file\r\n")
+	<-driver.called
+	c.Close()
+	select {
+	case err := <-driver.result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stat was not cancelled when the session ended")
+	}
+	<-done
+}
+
+func TestRetrAbortWhileOpening(t *testing.T) {
+	driver := blockingDriver{called: make(chan struct{}), result: make(chan error, 1)}
+	c, replies := newTestConn(nil)
+	defer c.Close()
+	c.driver = driver
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+	c.dataConn = pipeSocket{server}
+	done := sendCommand(c, "RETR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	<-driver.called
+
+	sendCommand(c, "ABOR\r\n")
+	expectReply(t, replies, "426")
+	expectReply(t, replies, "226")
+	if err := <-driver.result; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected GetFile to be cancelled, got %v", err)
+	}
+}
+
+func TestShutdownCancelsSessions(t *testing.T) {
+	s := NewServer(&ServerOpts{Logger: &DiscardLogger{}})
+	client, server := net.Pipe()
+	defer client.Close()
+	c := s.newConn(server, AdaptDriver(endlessDriver{}))
+	defer c.Close()
+
+	if err := c.Context().Err(); err != nil {
+		t.Fatalf("session context done before shutdown: %v", err)
+	}
+	s.Shutdown()
+	if err := c.Context().Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the session context to be cancelled, got %v", err)
+	}
+}
+
+func TestShutdownBeforeServe(t *testing.T) {
+	s := NewServer(&ServerOpts{Logger: &DiscardLogger{}})
+	s.Shutdown()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(listener); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestAdaptDriver(t *testing.T) {
+	driver := AdaptDriver(failingDriver{err: ErrNotFound})
+	if err := driver.DeleteFile(context.Background(), "/a"); err != ErrNotFound {
+		t.Errorf("expected the error of the driver, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := driver.DeleteFile(ctx, "/a"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if _, ok := unwrapDriver(driver).(failingDriver); !ok {
+		t.Error("unwrapDriver did not return the adapted driver")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// The errors a Driver should return, possibly wrapped with fmt.Errorf and
+// %w, so that the failure is answered with the right reply code. The
+// corresponding errors of the os package are recognized as well.
+var (
+	// ErrNotFound means the file or directory does not exist, 550
+	ErrNotFound = errors.New("file not found")
+	// ErrPermission means the user may not perform the action, 550
+	ErrPermission = errors.New("permission denied")
+	// ErrFileExists means the target of the action already exists, 550
+	ErrFileExists = errors.New("file already exists")
+	// ErrQuotaExceeded means the user is out of storage space, 552
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrNameNotAllowed means the file name is not acceptable, 553
+	ErrNameNotAllowed = errors.New("file name not allowed")
+	// ErrTemporary means the action may succeed if retried later, for
+	// example because the file is busy, 450
+	ErrTemporary = errors.New("temporary failure")
+	// ErrNotSupported means the driver cannot perform the action with
+	// the parameters given, 504
+	ErrNotSupported = errors.New("not supported")
+)
+
+// errorCode returns the reply code for the driver error err, or code when
+// err is not one of the known errors.
+func errorCode(err error, code int) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return 550
+	case errors.Is(err, ErrPermission), errors.Is(err, os.ErrPermission):
+		return 550
+	case errors.Is(err, ErrFileExists), errors.Is(err, os.ErrExist):
+		return 550
+	case errors.Is(err, ErrQuotaExceeded):
+		return 552
+	case errors.Is(err, ErrNameNotAllowed):
+		return 553
+	case errors.Is(err, ErrTemporary):
+		return 450
+	case errors.Is(err, ErrNotSupported):
+		return 504
+	}
+	return code
+}
+
+// errorMessage returns the default text of the reply to the driver error
+// err. The local path of an *fs.PathError is left out.
+func errorMessage(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// replyError answers a failed driver call. The reply code is chosen from
+// err, code being used for unknown errors, and the text is given by
+// ServerOpts.ErrorMessage if set.
+func (conn *Conn) replyError(code int, err error) {
+	code = errorCode(err, code)
+	message := errorMessage(err)
+	if conn.server.ErrorMessage != nil {
+		message = conn.server.ErrorMessage(conn, code, err)
+	}
+	conn.writeMessage(code, message)
+}
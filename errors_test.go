@@ -0,0 +1,65 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// failingDriver fails every deletion with err.
+type failingDriver struct {
+	Driver
+	err error
+}
+
+func (d failingDriver) DeleteFile(path string) error {
+	return d.err
+}
+
+func TestErrorCode(t *testing.T) {
+	var codeTests = []struct {
+		err  error
+		code int
+	}{
+		{ErrNotFound, 550},
+		{fmt.Errorf("/a.txt: %w", ErrNotFound), 550},
+		{&os.PathError{Op: "open", Path: "/srv/a.txt", Err: os.ErrNotExist}, 550},
+		{ErrPermission, 550},
+		{os.ErrPermission, 550},
+		{ErrFileExists, 550},
+		{ErrQuotaExceeded, 552},
+		{fmt.Errorf("upload: %w", ErrQuotaExceeded), 552},
+		{ErrNameNotAllowed, 553},
+		{ErrTemporary, 450},
+		{ErrNotSupported, 504},
+		{errors.New("disk on fire"), 451},
+	}
+	for _, tt := range codeTests {
+		if code := errorCode(tt.err, 451); code != tt.code {
+			t.Errorf("errorCode(%v) = %d, want %d", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	pathErr := &os.PathError{Op: "remove", Path: "/srv/ftp/a.txt", Err: os.ErrNotExist}
+	c, replies := newTestConn(failingDriver{err: pathErr})
+	defer c.Close()
+
+	done := sendCommand(c, "DELE a.txt\r\n")
+	expectReply(t, replies, "550 file does not exist")
+	<-done
+
+	c.driver = AdaptDriver(failingDriver{err: ErrQuotaExceeded})
+	c.server.ErrorMessage = func(conn *Conn, code int, err error) string {
+		return fmt.Sprintf("Cannot delete: %v", err)
+	}
+	done = sendCommand(c, "DELE a.txt\r\n")
+	expectReply(t, replies, "552 Cannot delete: quota exceeded")
+	<-done
+}
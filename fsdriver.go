@@ -0,0 +1,197 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// FSDriverFactory creates drivers serving the files of an fs.FS read-only,
+// such as an embed.FS, a *zip.Reader or an fstest.MapFS. Every change to
+// the files is refused with ErrPermission.
+type FSDriverFactory struct {
+	// The files served to the clients. Mandatory.
+	FS fs.FS
+
+	// The owner and group of all the files. Optional.
+	Owner string
+	Group string
+}
+
+// NewDriver returns a driver for a new session.
+func (factory *FSDriverFactory) NewDriver() (Driver, error) {
+	return &FSDriver{
+		fsys:  factory.FS,
+		owner: factory.Owner,
+		group: factory.Group,
+	}, nil
+}
+
+// FSDriver is the Driver of a session on the fs.FS of an FSDriverFactory.
+// It also implements Perm, refusing every change.
+type FSDriver struct {
+	fsys  fs.FS
+	owner string
+	group string
+}
+
+// rootName converts an absolute FTP path to a name relative to the root,
+// as used by fs.FS and os.Root.
+func rootName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// fsFileInfo adds the owner and group of an FSDriver to an fs.FileInfo.
+type fsFileInfo struct {
+	fs.FileInfo
+	owner string
+	group string
+}
+
+func (f fsFileInfo) Owner() string {
+	return f.owner
+}
+
+func (f fsFileInfo) Group() string {
+	return f.group
+}
+
+func (driver *FSDriver) Init(conn *Conn) {
+}
+
+func (driver *FSDriver) readOnly(name string) error {
+	return fmt.Errorf("%s: read-only file system: %w", name, ErrPermission)
+}
+
+func (driver *FSDriver) Stat(name string) (FileInfo, error) {
+	info, err := fs.Stat(driver.fsys, rootName(name))
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo{info, driver.owner, driver.group}, nil
+}
+
+func (driver *FSDriver) ChangeDir(name string) error {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", name)
+	}
+	return nil
+}
+
+func (driver *FSDriver) ListDir(name string, callback func(FileInfo) error) error {
+	entries, err := fs.ReadDir(driver.fsys, rootName(name))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if err := callback(fsFileInfo{info, driver.owner, driver.group}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *FSDriver) DeleteDir(name string) error {
+	return driver.readOnly(name)
+}
+
+func (driver *FSDriver) DeleteFile(name string) error {
+	return driver.readOnly(name)
+}
+
+func (driver *FSDriver) Rename(fromPath string, toPath string) error {
+	return driver.readOnly(fromPath)
+}
+
+func (driver *FSDriver) MakeDir(name string) error {
+	return driver.readOnly(name)
+}
+
+// GetFile opens a file, seeking to offset if the file implements
+// io.Seeker and skipping the data before it otherwise.
+func (driver *FSDriver) GetFile(name string, offset int64) (int64, io.ReadCloser, error) {
+	f, err := driver.fsys.Open(rootName(name))
+	if err != nil {
+		return 0, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return 0, nil, fmt.Errorf("%s: is a directory", name)
+	}
+	if offset < 0 || offset > info.Size() {
+		f.Close()
+		return 0, nil, fmt.Errorf("%s: invalid offset %d", name, offset)
+	}
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, f, offset)
+	}
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	return info.Size() - offset, f, nil
+}
+
+func (driver *FSDriver) PutFile(name string, data io.Reader, appendData bool) (int64, error) {
+	return 0, driver.readOnly(name)
+}
+
+func (driver *FSDriver) GetOwner(name string) (string, error) {
+	if _, err := driver.Stat(name); err != nil {
+		return "", err
+	}
+	return driver.owner, nil
+}
+
+func (driver *FSDriver) GetGroup(name string) (string, error) {
+	if _, err := driver.Stat(name); err != nil {
+		return "", err
+	}
+	return driver.group, nil
+}
+
+func (driver *FSDriver) GetMode(name string) (os.FileMode, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Mode(), nil
+}
+
+func (driver *FSDriver) ChOwner(name string, owner string) error {
+	return driver.readOnly(name)
+}
+
+func (driver *FSDriver) ChGroup(name string, group string) error {
+	return driver.readOnly(name)
+}
+
+func (driver *FSDriver) ChMode(name string, mode os.FileMode) error {
+	return driver.readOnly(name)
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newZipFS(t *testing.T, files map[string]string) fs.FS {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestFSDriver(t *testing.T) {
+	files := map[string]string{
+		"a.txt":     "hello world",
+		"dir/b.txt": "b",
+	}
+	mapFS := fstest.MapFS{}
+	for name, content := range files {
+		mapFS[name] = &fstest.MapFile{Data: []byte(content), Mode: 0644}
+	}
+
+	for name, fsys := range map[string]fs.FS{"MapFS": mapFS, "zip": newZipFS(t, files)} {
+		t.Run(name, func(t *testing.T) {
+			factory := &FSDriverFactory{FS: fsys, Owner: "www", Group: "web"}
+			driver, err := factory.NewDriver()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := driver.Stat("/a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != 11 || info.Owner() != "www" || info.Group() != "web" {
+				t.Errorf("unexpected file info %d %s %s", info.Size(), info.Owner(), info.Group())
+			}
+			if err := driver.ChangeDir("/dir"); err != nil {
+				t.Error(err)
+			}
+			if got := readMemFile(t, driver, "/a.txt", 0); got != "hello world" {
+				t.Errorf("got %q", got)
+			}
+			if got := readMemFile(t, driver, "/a.txt", 6); got != "world" {
+				t.Errorf("got %q from offset 6", got)
+			}
+
+			var names []string
+			driver.ListDir("/", func(f FileInfo) error {
+				names = append(names, f.Name())
+				return nil
+			})
+			if strings.Join(names, " ") != "a.txt dir" {
+				t.Errorf("got %v in /", names)
+			}
+
+			if _, err := driver.PutFile("/c.txt", strings.NewReader("c"), false); !errors.Is(err, ErrPermission) {
+				t.Errorf("expected ErrPermission from PutFile, got %v", err)
+			}
+			var mutations = []error{
+				driver.DeleteFile("/a.txt"),
+				driver.DeleteDir("/dir"),
+				driver.MakeDir("/new"),
+				driver.Rename("/a.txt", "/b.txt"),
+			}
+			for _, err := range mutations {
+				if !errors.Is(err, ErrPermission) {
+					t.Errorf("expected ErrPermission, got %v", err)
+				}
+			}
+		})
+	}
+}
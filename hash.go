@@ -0,0 +1,96 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// The hash algorithms understood by HASH, named as in
+// draft-bryan-ftpext-hash.
+const (
+	HashCRC32  = "CRC32"
+	HashMD5    = "MD5"
+	HashSHA1   = "SHA-1"
+	HashSHA256 = "SHA-256"
+	HashSHA512 = "SHA-512"
+
+	defaultHashAlgo = HashSHA256
+)
+
+var hashAlgos = []string{HashSHA1, HashSHA256, HashSHA512, HashMD5, HashCRC32}
+
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case HashCRC32:
+		return crc32.NewIEEE()
+	case HashMD5:
+		return md5.New()
+	case HashSHA1:
+		return sha1.New()
+	case HashSHA256:
+		return sha256.New()
+	case HashSHA512:
+		return sha512.New()
+	}
+	return nil
+}
+
+// parseHashAlgo returns the canonical name of algo, or "" if it is not
+// supported.
+func parseHashAlgo(algo string) string {
+	for _, a := range hashAlgos {
+		if strings.EqualFold(a, algo) {
+			return a
+		}
+	}
+	return ""
+}
+
+// hashFeat formats the supported algorithms for the FEAT reply, marking the
+// currently selected one with '*'.
+func hashFeat(selected string) string {
+	var algos []string
+	for _, a := range hashAlgos {
+		if a == selected {
+			a += "*"
+		}
+		algos = append(algos, a)
+	}
+	return strings.Join(algos, ";")
+}
+
+// fileHash computes the hex encoded checksum of the bytes in [start, end) of
+// path. An end of -1 means the end of the file. Drivers implementing
+// HashDriver are asked first when the whole file is requested.
+func (conn *Conn) fileHash(path, algo string, start, end int64) (string, error) {
+	if hd, ok := unwrapDriver(conn.driver).(HashDriver); ok && start == 0 && end < 0 {
+		return hd.Hash(path, algo)
+	}
+
+	_, data, err := conn.driver.GetFile(conn.Context(), path, start)
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+
+	var r io.Reader = data
+	if end >= 0 {
+		r = io.LimitReader(data, end-start)
+	}
+	h := newHash(algo)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
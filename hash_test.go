@@ -0,0 +1,66 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// hashingDriver returns a fixed checksum for whole files.
+type hashingDriver struct {
+	*MemDriver
+}
+
+func (d hashingDriver) Hash(path, algo string) (string, error) {
+	return "stored-" + algo, nil
+}
+
+func TestHash(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	if _, err := memDriver.PutFile("/a.txt", strings.NewReader("0123456789"), false); err != nil {
+		t.Fatal(err)
+	}
+	c, replies := newTestConn(hashingDriver{memDriver})
+	defer c.Close()
+	c.hashAlgo = defaultHashAlgo
+	c.rangeEnd = -1
+
+	sum := func(data string) string {
+		h := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(h[:])
+	}
+	var hashTests = []struct {
+		line  string
+		reply string
+	}{
+		{"HASH a.txt", "213 SHA-256 0-9 stored-SHA-256 a.txt"},
+		{"RANG 1 3", "350 Restarting at 1. Ending byte at 3"},
+		{"HASH a.txt", "213 SHA-256 1-3 " + sum("123") + " a.txt"},
+		{"RANG 4 100", "350 Restarting at 4. Ending byte at 100"},
+		{"HASH a.txt", "213 SHA-256 4-9 " + sum("456789") + " a.txt"},
+		{"RANG 0 9", "350 Restarting at 0. Ending byte at 9"},
+		{"HASH a.txt", "213 SHA-256 0-9 stored-SHA-256 a.txt"},
+		{"RANG 20 30", "350 Restarting at 20. Ending byte at 30"},
+		{"HASH a.txt", "501 Invalid byte range"},
+	}
+	for _, tt := range hashTests {
+		done := sendCommand(c, tt.line+"\r\n")
+		if reply := readMultiline(t, replies); reply != tt.reply {
+			t.Errorf("%s: expected reply %q, got %q", tt.line, tt.reply, reply)
+		}
+		<-done
+	}
+
+	// RANG only applies to HASH, transfers ignore it
+	done := sendCommand(c, "FEAT\r\n")
+	if feats := readMultiline(t, replies); strings.Contains(feats, "RANG") {
+		t.Errorf("RANG advertised: %q", feats)
+	}
+	<-done
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandSyntax may be implemented by a Command to describe its parameters
+// in the reply to HELP, for example "RETR <sp> pathname".
+type CommandSyntax interface {
+	Syntax() string
+}
+
+var (
+	// commandSyntaxes holds the syntax of the built-in commands
+	commandSyntaxes = map[string]string{
+		"ABOR":    "ABOR",
+		"ADAT":    "ADAT <sp> base64-data",
+		"ALLO":    "ALLO <sp> decimal-integer",
+		"APPE":    "APPE <sp> pathname",
+		"AUTH":    "AUTH <sp> mechanism-name",
+		"AVBL":    "AVBL [ <sp> pathname ]",
+		"CCC":     "CCC",
+		"CDUP":    "CDUP",
+		"CONF":    "CONF <sp> base64-data",
+		"CWD":     "CWD <sp> pathname",
+		"DELE":    "DELE <sp> pathname",
+		"ENC":     "ENC <sp> base64-data",
+		"EPRT":    "EPRT <sp> |proto|addr|port|",
+		"EPSV":    "EPSV [ <sp> proto | ALL ]",
+		"FEAT":    "FEAT",
+		"HASH":    "HASH <sp> pathname",
+		"HELP":    "HELP [ <sp> command ]",
+		"LIST":    "LIST [ <sp> pathname ]",
+		"LPRT":    "LPRT <sp> af,hal,h1,...,pal,p1,...",
+		"MDTM":    "MDTM <sp> pathname",
+		"MFCT":    "MFCT <sp> YYYYMMDDHHMMSS <sp> pathname",
+		"MFMT":    "MFMT <sp> YYYYMMDDHHMMSS <sp> pathname",
+		"MIC":     "MIC <sp> base64-data",
+		"MKD":     "MKD <sp> pathname",
+		"MLSD":    "MLSD [ <sp> pathname ]",
+		"MLST":    "MLST [ <sp> pathname ]",
+		"MODE":    "MODE <sp> S | Z",
+		"NLST":    "NLST [ <sp> pathname ]",
+		"NOOP":    "NOOP",
+		"OPTS":    "OPTS <sp> command [ <sp> options ]",
+		"PASS":    "PASS <sp> password",
+		"PASV":    "PASV",
+		"PBSZ":    "PBSZ <sp> decimal-integer",
+		"PORT":    "PORT <sp> h1,h2,h3,h4,p1,p2",
+		"PROT":    "PROT <sp> C | P",
+		"PWD":     "PWD",
+		"QUIT":    "QUIT",
+		"RANG":    "RANG <sp> start-point <sp> end-point",
+		"REST":    "REST <sp> offset",
+		"RETR":    "RETR <sp> pathname",
+		"RMD":     "RMD <sp> pathname",
+		"RNFR":    "RNFR <sp> pathname",
+		"RNTO":    "RNTO <sp> pathname",
+		"SITE":    "SITE <sp> command [ <sp> arguments ]",
+		"SIZE":    "SIZE <sp> pathname",
+		"STAT":    "STAT [ <sp> pathname ]",
+		"STOR":    "STOR <sp> pathname",
+		"STRU":    "STRU <sp> F",
+		"SYST":    "SYST",
+		"TYPE":    "TYPE <sp> A | I",
+		"USER":    "USER <sp> username",
+		"XCRC":    "XCRC <sp> pathname [ <sp> start <sp> end ]",
+		"XCUP":    "XCUP",
+		"XCWD":    "XCWD <sp> pathname",
+		"XMD5":    "XMD5 <sp> pathname [ <sp> start <sp> end ]",
+		"XMKD":    "XMKD <sp> pathname",
+		"XPWD":    "XPWD",
+		"XRMD":    "XRMD <sp> pathname",
+		"XSHA1":   "XSHA1 <sp> pathname [ <sp> start <sp> end ]",
+		"XSHA256": "XSHA256 <sp> pathname [ <sp> start <sp> end ]",
+		"XSHA512": "XSHA512 <sp> pathname [ <sp> start <sp> end ]",
+	}
+
+	// siteSyntaxes holds the syntax of the SITE subcommands
+	siteSyntaxes = map[string]string{
+		"CHGRP":    "SITE CHGRP <sp> group <sp> pathname",
+		"CHMOD":    "SITE CHMOD <sp> mode <sp> pathname",
+		"CHOWN":    "SITE CHOWN <sp> owner <sp> pathname",
+		"CPFR":     "SITE CPFR <sp> pathname",
+		"CPTO":     "SITE CPTO <sp> pathname",
+		"HELP":     "SITE HELP [ <sp> command ]",
+		"QUOTA":    "SITE QUOTA",
+		"READLINK": "SITE READLINK <sp> pathname",
+		"SYMLINK":  "SITE SYMLINK <sp> target <sp> pathname",
+		"UTIME":    "SITE UTIME <sp> YYYYMMDDhhmmss <sp> pathname",
+	}
+)
+
+// commandSyntax returns the syntax of the command registered as name,
+// falling back to its bare name when it does not document one.
+func commandSyntax(name string, cmd Command, syntaxes map[string]string) string {
+	if s, ok := cmd.(CommandSyntax); ok {
+		return s.Syntax()
+	}
+	if syntax, ok := syntaxes[name]; ok {
+		return syntax
+	}
+	return name
+}
+
+// helpList formats names in columns for a multiline 214 reply.
+func helpList(title string, names []string) string {
+	const perLine = 8
+	lines := []string{title}
+	for i := 0; i < len(names); i += perLine {
+		end := i + perLine
+		if end > len(names) {
+			end = len(names)
+		}
+		var line string
+		for _, name := range names[i:end] {
+			line += fmt.Sprintf("%-8s", name)
+		}
+		lines = append(lines, " "+strings.TrimRight(line, " "))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// commandHelp responds to the HELP FTP command. Without a parameter it
+// lists the commands the client may use, with one it describes the syntax
+// of that command.
+type commandHelp struct{}
+
+func (cmd commandHelp) IsExtend() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireParam() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandHelp) Execute(conn *Conn, param string) {
+	if fields := strings.Fields(param); len(fields) > 0 {
+		name := strings.ToUpper(fields[0])
+		helpCmd, ok := conn.server.LookupCommand(name)
+		if !ok || !conn.commandEnabled(name) {
+			conn.writeMessage(502, "Unknown command "+name)
+			return
+		}
+		conn.writeMessage(214, "Syntax: "+commandSyntax(name, helpCmd, commandSyntaxes))
+		return
+	}
+
+	var names []string
+	for _, name := range conn.server.commandNames() {
+		if conn.commandEnabled(name) {
+			names = append(names, name)
+		}
+	}
+	conn.writeMessageMultiline(214, helpList("The following commands are recognized:", names))
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHelp(t *testing.T) {
+	c, replies := newTestConn(newMemDriver(t))
+	defer c.Close()
+	c.server = NewServer(&ServerOpts{
+		Logger:           &DiscardLogger{},
+		Auth:             &SimpleAuth{Name: "admin", Password: "admin"},
+		DisabledCommands: []string{"DELE"},
+	})
+	c.server.RegisterCommand("XYZZY", commandXyzzy{})
+
+	done := sendCommand(c, "HELP\r\n")
+	help := readMultiline(t, replies)
+	<-done
+	if !strings.HasPrefix(help, "214-") || !strings.Contains(help, " XYZZY") || !strings.Contains(help, " RETR ") {
+		t.Errorf("unexpected HELP reply %q", help)
+	}
+	if strings.Contains(help, "DELE") {
+		t.Errorf("HELP lists disabled command DELE: %q", help)
+	}
+
+	var helpTests = []struct {
+		line  string
+		reply string
+	}{
+		{"HELP retr", "214 Syntax: RETR <sp> pathname"},
+		{"HELP XYZZY", "214 Syntax: XYZZY"},
+		{"HELP DELE", "502"},
+		{"HELP BOGUS", "502"},
+		{"SITE HELP chmod", "214 Syntax: SITE CHMOD <sp> mode <sp> pathname"},
+		{"SITE HELP BOGUS", "502"},
+	}
+	for _, tt := range helpTests {
+		done := sendCommand(c, tt.line+"\r\n")
+		expectReply(t, replies, tt.reply)
+		<-done
+	}
+
+	done = sendCommand(c, "SITE HELP\r\n")
+	help = readMultiline(t, replies)
+	<-done
+	if !strings.Contains(help, "\n SITE UTIME <sp>") || !strings.Contains(help, "\n SITE CPFR <sp>") {
+		t.Errorf("unexpected SITE HELP reply %q", help)
+	}
+	// the driver does not implement SymlinkDriver
+	if strings.Contains(help, "SYMLINK") || strings.Contains(help, "QUOTA") {
+		t.Errorf("SITE HELP lists unavailable commands: %q", help)
+	}
+}
@@ -7,6 +7,8 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -28,15 +30,133 @@ func (formatter listFormatter) Short() []byte {
 func (formatter listFormatter) Detailed() []byte {
 	var buf bytes.Buffer
 	for _, file := range formatter {
-		fmt.Fprintf(&buf, file.Mode().String())
+		buf.WriteString(file.Mode().String())
 		fmt.Fprintf(&buf, " 1 %s %s ", file.Owner(), file.Group())
-		fmt.Fprintf(&buf, lpad(strconv.FormatInt(file.Size(), 10), 12))
-		fmt.Fprintf(&buf, file.ModTime().Format(" Jan _2 15:04 "))
+		buf.WriteString(lpad(strconv.FormatInt(file.Size(), 10), 12))
+		buf.WriteString(file.ModTime().Format(" Jan _2 15:04 "))
 		fmt.Fprintf(&buf, "%s\r\n", file.Name())
 	}
 	return buf.Bytes()
 }
 
+// Machine returns a string that lists the collection of files in the
+// machine readable format of RFC 3659 MLSD, one per line. dir is the
+// directory the files live in and facts the list of facts to include.
+func (formatter listFormatter) Machine(dir string, facts []string) []byte {
+	var buf bytes.Buffer
+	for _, file := range formatter {
+		buf.WriteString(mlstEntry(file, path.Join(dir, file.Name()), facts))
+		fmt.Fprintf(&buf, "%s\r\n", file.Name())
+	}
+	return buf.Bytes()
+}
+
+// supportedMlstFacts are the facts the server knows how to compute, in the
+// order they are written.
+var supportedMlstFacts = []string{"type", "size", "modify", "perm", "unique"}
+
+// parseMlstFacts parses the argument of OPTS MLST, a list of fact names
+// each terminated by ';', and returns the supported ones.
+func parseMlstFacts(param string) []string {
+	facts := []string{}
+	for _, fact := range strings.Split(param, ";") {
+		for _, supported := range supportedMlstFacts {
+			if strings.EqualFold(fact, supported) {
+				facts = append(facts, supported)
+			}
+		}
+	}
+	return facts
+}
+
+// mlstFactList formats a list of fact names as sent back by OPTS MLST.
+func mlstFactList(facts []string) string {
+	var buf bytes.Buffer
+	for _, fact := range facts {
+		buf.WriteString(fact + ";")
+	}
+	return buf.String()
+}
+
+// mlstFeat formats the supported facts for the FEAT reply, marking the
+// currently selected ones with '*'.
+func mlstFeat(selected []string) string {
+	var buf bytes.Buffer
+	for _, fact := range supportedMlstFacts {
+		buf.WriteString(fact)
+		if hasMlstFact(selected, fact) {
+			buf.WriteString("*")
+		}
+		buf.WriteString(";")
+	}
+	return buf.String()
+}
+
+func hasMlstFact(facts []string, fact string) bool {
+	for _, f := range facts {
+		if f == fact {
+			return true
+		}
+	}
+	return false
+}
+
+// mlstEntry returns the fact part of a MLST or MLSD line for file, ending
+// with the space that separates the facts from the pathname.
+func mlstEntry(file FileInfo, fullPath string, facts []string) string {
+	var buf bytes.Buffer
+	for _, fact := range facts {
+		switch fact {
+		case "type":
+			if file.IsDir() {
+				buf.WriteString("type=dir;")
+			} else {
+				buf.WriteString("type=file;")
+			}
+		case "size":
+			fmt.Fprintf(&buf, "size=%d;", file.Size())
+		case "modify":
+			fmt.Fprintf(&buf, "modify=%s;", file.ModTime().UTC().Format("20060102150405"))
+		case "perm":
+			fmt.Fprintf(&buf, "perm=%s;", mlstPerm(file))
+		case "unique":
+			h := fnv.New64a()
+			h.Write([]byte(fullPath))
+			fmt.Fprintf(&buf, "unique=%x;", h.Sum64())
+		}
+	}
+	buf.WriteString(" ")
+	return buf.String()
+}
+
+// mlstPerm derives the RFC 3659 perm fact from the file mode.
+func mlstPerm(file FileInfo) string {
+	mode := file.Mode().Perm()
+	readable := mode&0444 != 0
+	writable := mode&0222 != 0
+
+	var perm string
+	if file.IsDir() {
+		if mode&0111 != 0 {
+			perm += "e"
+		}
+		if readable {
+			perm += "l"
+		}
+		if writable {
+			perm += "cmpdf"
+		}
+	} else {
+		if readable {
+			perm += "r"
+		}
+		if writable {
+			perm += "awdf"
+		}
+	}
+	return perm
+}
+
 func lpad(input string, length int) (result string) {
 	if len(input) < length {
 		result = strings.Repeat(" ", length-len(input)) + input
@@ -0,0 +1,64 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type mockFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f mockFileInfo) Name() string       { return f.name }
+func (f mockFileInfo) Size() int64        { return f.size }
+func (f mockFileInfo) Mode() os.FileMode  { return f.mode }
+func (f mockFileInfo) ModTime() time.Time { return f.modTime }
+func (f mockFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f mockFileInfo) Sys() interface{}   { return nil }
+func (f mockFileInfo) Owner() string      { return "owner" }
+func (f mockFileInfo) Group() string      { return "group" }
+
+func TestListFormatterMachine(t *testing.T) {
+	modTime := time.Date(2009, 11, 10, 23, 0, 0, 0, time.FixedZone("", 3600))
+	files := listFormatter{
+		mockFileInfo{name: " leading space.txt", size: 4, mode: 0644, modTime: modTime},
+		mockFileInfo{name: "dir", mode: os.ModeDir | 0555, modTime: modTime},
+	}
+
+	got := string(files.Machine("/", []string{"type", "size", "modify", "perm"}))
+	want := "type=file;size=4;modify=20091110220000;perm=rawdf;  leading space.txt\r\n" +
+		"type=dir;size=0;modify=20091110220000;perm=el; dir\r\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseMlstFacts(t *testing.T) {
+	var factTests = []struct {
+		in  string
+		out string
+	}{
+		{"", ""},
+		{"type;size;", "type;size;"},
+		{"Size;TYPE;unknown;", "size;type;"},
+		{"modify;perm;unique", "modify;perm;unique;"},
+	}
+	for _, tt := range factTests {
+		s := mlstFactList(parseMlstFacts(tt.in))
+		if s != tt.out {
+			t.Errorf("parseMlstFacts(%q): got %q, want %q", tt.in, s, tt.out)
+		}
+	}
+
+	if s := mlstFeat([]string{"type", "size"}); s != "type*;size*;modify;perm;unique;" {
+		t.Errorf("mlstFeat: got %q", s)
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemDriverFactory creates drivers sharing a file system held in memory,
+// for tests and short-lived servers. It is safe for concurrent use by any
+// number of sessions.
+type MemDriverFactory struct {
+	fs *memFS
+}
+
+// NewMemDriverFactory returns a MemDriverFactory with an empty root
+// directory. Files are owned by the user who created them and belong to
+// group. Anonymous sessions create files owned by owner.
+func NewMemDriverFactory(owner, group string) *MemDriverFactory {
+	fs := &memFS{
+		owner: owner,
+		group: group,
+		files: map[string]*memFile{},
+	}
+	fs.files["/"] = &memFile{
+		mode:    os.ModeDir | 0755,
+		modTime: time.Now(),
+		owner:   owner,
+		group:   group,
+	}
+	return &MemDriverFactory{fs: fs}
+}
+
+// NewDriver returns a driver for a new session.
+func (factory *MemDriverFactory) NewDriver() (Driver, error) {
+	return &MemDriver{fs: factory.fs}, nil
+}
+
+// memFS is the file system shared by the drivers of a MemDriverFactory,
+// indexed by clean absolute path.
+type memFS struct {
+	lock  sync.RWMutex
+	owner string
+	group string
+	files map[string]*memFile
+}
+
+// memFile is a file or directory of a memFS. The data of a file is never
+// modified in place, so that readers can keep using a previous version.
+type memFile struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	owner   string
+	group   string
+}
+
+// memFileInfo is a snapshot of a memFile.
+type memFileInfo struct {
+	name string
+	memFile
+}
+
+func (f *memFileInfo) Name() string       { return f.name }
+func (f *memFileInfo) Size() int64        { return int64(len(f.data)) }
+func (f *memFileInfo) Mode() os.FileMode  { return f.mode }
+func (f *memFileInfo) ModTime() time.Time { return f.modTime }
+func (f *memFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *memFileInfo) Sys() interface{}   { return nil }
+func (f *memFileInfo) Owner() string      { return f.owner }
+func (f *memFileInfo) Group() string      { return f.group }
+
+// MemDriver is the Driver of a session on the file system of a
+// MemDriverFactory. It also implements Perm, TimesDriver, RestartDriver,
+// CopyDriver and TruncateDriver.
+type MemDriver struct {
+	fs   *memFS
+	conn *Conn
+}
+
+func (driver *MemDriver) Init(conn *Conn) {
+	driver.conn = conn
+}
+
+func cleanMemPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// lookup returns the file at name. Callers must hold the lock.
+func (driver *MemDriver) lookup(name string) (*memFile, error) {
+	file, ok := driver.fs.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return file, nil
+}
+
+// lookupDir returns the directory at name. Callers must hold the lock.
+func (driver *MemDriver) lookupDir(name string) (*memFile, error) {
+	file, err := driver.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !file.mode.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", name)
+	}
+	return file, nil
+}
+
+// newFile returns a file or directory owned by the user of the session.
+func (driver *MemDriver) newFile(mode os.FileMode) *memFile {
+	owner := driver.fs.owner
+	if driver.conn != nil && driver.conn.IsLogin() {
+		owner = driver.conn.LoginUser()
+	}
+	return &memFile{
+		mode:    mode,
+		modTime: time.Now(),
+		owner:   owner,
+		group:   driver.fs.group,
+	}
+}
+
+func (driver *MemDriver) Stat(name string) (FileInfo, error) {
+	name = cleanMemPath(name)
+	driver.fs.lock.RLock()
+	defer driver.fs.lock.RUnlock()
+	file, err := driver.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFileInfo{path.Base(name), *file}, nil
+}
+
+func (driver *MemDriver) ChangeDir(name string) error {
+	name = cleanMemPath(name)
+	driver.fs.lock.RLock()
+	defer driver.fs.lock.RUnlock()
+	_, err := driver.lookupDir(name)
+	return err
+}
+
+func (driver *MemDriver) ListDir(name string, callback func(FileInfo) error) error {
+	name = cleanMemPath(name)
+	driver.fs.lock.RLock()
+	if _, err := driver.lookupDir(name); err != nil {
+		driver.fs.lock.RUnlock()
+		return err
+	}
+	var files []FileInfo
+	for filePath, file := range driver.fs.files {
+		if filePath != "/" && path.Dir(filePath) == name {
+			files = append(files, &memFileInfo{path.Base(filePath), *file})
+		}
+	}
+	driver.fs.lock.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, f := range files {
+		if err := callback(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *MemDriver) DeleteDir(name string) error {
+	name = cleanMemPath(name)
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	if name == "/" {
+		return fmt.Errorf("%s: %w", name, ErrPermission)
+	}
+	if _, err := driver.lookupDir(name); err != nil {
+		return err
+	}
+	for filePath := range driver.fs.files {
+		if path.Dir(filePath) == name {
+			return fmt.Errorf("%s: directory not empty", name)
+		}
+	}
+	delete(driver.fs.files, name)
+	return nil
+}
+
+func (driver *MemDriver) DeleteFile(name string) error {
+	name = cleanMemPath(name)
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	file, err := driver.lookup(name)
+	if err != nil {
+		return err
+	}
+	if file.mode.IsDir() {
+		return fmt.Errorf("%s: is a directory", name)
+	}
+	delete(driver.fs.files, name)
+	return nil
+}
+
+func (driver *MemDriver) Rename(fromPath string, toPath string) error {
+	fromPath = cleanMemPath(fromPath)
+	toPath = cleanMemPath(toPath)
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	file, err := driver.lookup(fromPath)
+	if err != nil {
+		return err
+	}
+	if fromPath == "/" || strings.HasPrefix(toPath, fromPath+"/") {
+		return fmt.Errorf("%s: cannot move a directory into itself", fromPath)
+	}
+	if _, err := driver.lookupDir(path.Dir(toPath)); err != nil {
+		return err
+	}
+	if target, ok := driver.fs.files[toPath]; ok && (target.mode.IsDir() || file.mode.IsDir()) {
+		return fmt.Errorf("%s: %w", toPath, ErrFileExists)
+	}
+
+	moved := map[string]*memFile{toPath: file}
+	for filePath, child := range driver.fs.files {
+		if filePath == fromPath || strings.HasPrefix(filePath, fromPath+"/") {
+			delete(driver.fs.files, filePath)
+			moved[toPath+strings.TrimPrefix(filePath, fromPath)] = child
+		}
+	}
+	for filePath, child := range moved {
+		driver.fs.files[filePath] = child
+	}
+	return nil
+}
+
+func (driver *MemDriver) MakeDir(name string) error {
+	name = cleanMemPath(name)
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	if _, ok := driver.fs.files[name]; ok {
+		return fmt.Errorf("%s: %w", name, ErrFileExists)
+	}
+	if _, err := driver.lookupDir(path.Dir(name)); err != nil {
+		return err
+	}
+	driver.fs.files[name] = driver.newFile(os.ModeDir | 0755)
+	return nil
+}
+
+func (driver *MemDriver) GetFile(name string, offset int64) (int64, io.ReadCloser, error) {
+	name = cleanMemPath(name)
+	driver.fs.lock.RLock()
+	defer driver.fs.lock.RUnlock()
+	file, err := driver.lookup(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if file.mode.IsDir() {
+		return 0, nil, fmt.Errorf("%s: is a directory", name)
+	}
+	if offset < 0 || offset > int64(len(file.data)) {
+		return 0, nil, fmt.Errorf("%s: invalid offset %d", name, offset)
+	}
+	data := file.data[offset:]
+	return int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (driver *MemDriver) PutFile(name string, data io.Reader, appendData bool) (int64, error) {
+	name = cleanMemPath(name)
+	// the data is read before taking the lock, it may take a while
+	received, err := ioutil.ReadAll(data)
+	if err != nil {
+		return int64(len(received)), err
+	}
+
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	if _, err := driver.lookupDir(path.Dir(name)); err != nil {
+		return 0, err
+	}
+	file, ok := driver.fs.files[name]
+	if ok && file.mode.IsDir() {
+		return 0, fmt.Errorf("%s: is a directory", name)
+	}
+	if !ok {
+		file = driver.newFile(0644)
+		driver.fs.files[name] = file
+	}
+	if appendData {
+		file.data = append(file.data[:len(file.data):len(file.data)], received...)
+	} else {
+		file.data = received
+	}
+	file.modTime = time.Now()
+	return int64(len(received)), nil
+}
+
+// PutFileAt replaces the data of a file from offset.
+func (driver *MemDriver) PutFileAt(name string, offset int64, data io.Reader) (int64, error) {
+	name = cleanMemPath(name)
+	received, err := ioutil.ReadAll(data)
+	if err != nil {
+		return int64(len(received)), err
+	}
+
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	file, err := driver.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	if file.mode.IsDir() {
+		return 0, fmt.Errorf("%s: is a directory", name)
+	}
+	if offset < 0 || offset > int64(len(file.data)) {
+		return 0, fmt.Errorf("%s: invalid offset %d", name, offset)
+	}
+	file.data = append(file.data[:offset:offset], received...)
+	file.modTime = time.Now()
+	return int64(len(received)), nil
+}
+
+// update calls fn with the file at name under the lock.
+func (driver *MemDriver) update(name string, fn func(*memFile)) error {
+	name = cleanMemPath(name)
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	file, err := driver.lookup(name)
+	if err != nil {
+		return err
+	}
+	fn(file)
+	return nil
+}
+
+func (driver *MemDriver) GetOwner(name string) (string, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return info.Owner(), nil
+}
+
+func (driver *MemDriver) GetGroup(name string) (string, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return info.Group(), nil
+}
+
+func (driver *MemDriver) GetMode(name string) (os.FileMode, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Mode(), nil
+}
+
+func (driver *MemDriver) ChOwner(name string, owner string) error {
+	return driver.update(name, func(file *memFile) { file.owner = owner })
+}
+
+func (driver *MemDriver) ChGroup(name string, group string) error {
+	return driver.update(name, func(file *memFile) { file.group = group })
+}
+
+func (driver *MemDriver) ChMode(name string, mode os.FileMode) error {
+	return driver.update(name, func(file *memFile) {
+		file.mode = file.mode&os.ModeType | mode&os.ModePerm
+	})
+}
+
+// SetTimes sets the modification time of a file, the memory file system
+// keeps no access or creation times. A creation time is refused with
+// ErrNotSupported.
+func (driver *MemDriver) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	if !ctime.IsZero() {
+		return fmt.Errorf("%s: creation time: %w", name, ErrNotSupported)
+	}
+	return driver.update(name, func(file *memFile) {
+		if !mtime.IsZero() {
+			file.modTime = mtime
+		}
+	})
+}
+
+// CopyFile copies a file, the copy being owned by the logged in user.
+func (driver *MemDriver) CopyFile(fromPath string, toPath string) error {
+	fromPath = cleanMemPath(fromPath)
+	toPath = cleanMemPath(toPath)
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	file, err := driver.lookup(fromPath)
+	if err != nil {
+		return err
+	}
+	if file.mode.IsDir() {
+		return fmt.Errorf("%s: is a directory", fromPath)
+	}
+	if _, err := driver.lookupDir(path.Dir(toPath)); err != nil {
+		return err
+	}
+	if target, ok := driver.fs.files[toPath]; ok && target.mode.IsDir() {
+		return fmt.Errorf("%s: %w", toPath, ErrFileExists)
+	}
+	copied := driver.newFile(file.mode)
+	copied.data = append([]byte(nil), file.data...)
+	driver.fs.files[toPath] = copied
+	return nil
+}
+
+func (driver *MemDriver) Truncate(name string, size int64) error {
+	name = cleanMemPath(name)
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	file, err := driver.lookup(name)
+	if err != nil {
+		return err
+	}
+	if file.mode.IsDir() {
+		return fmt.Errorf("%s: is a directory", name)
+	}
+	if size < 0 || size > int64(len(file.data)) {
+		return fmt.Errorf("%s: invalid size %d", name, size)
+	}
+	file.data = file.data[:size:size]
+	file.modTime = time.Now()
+	return nil
+}
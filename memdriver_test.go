@@ -0,0 +1,174 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newMemDriver(t *testing.T) *MemDriver {
+	t.Helper()
+	driver, err := NewMemDriverFactory("owner", "group").NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver.(*MemDriver)
+}
+
+func readMemFile(t *testing.T, driver Driver, name string, offset int64) string {
+	t.Helper()
+	_, data, err := driver.GetFile(name, offset)
+	if err != nil {
+		t.Fatalf("GetFile(%s): %v", name, err)
+	}
+	defer data.Close()
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func listMemDir(t *testing.T, driver Driver, name string) string {
+	t.Helper()
+	var names []string
+	err := driver.ListDir(name, func(f FileInfo) error {
+		names = append(names, f.Name())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListDir(%s): %v", name, err)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestMemDriverFiles(t *testing.T) {
+	driver := newMemDriver(t)
+	driver.Init(&Conn{user: "alice"})
+
+	if _, err := driver.PutFile("/a.txt", strings.NewReader("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.PutFile("/a.txt", strings.NewReader(" world"), true); err != nil {
+		t.Fatal(err)
+	}
+	if content := readMemFile(t, driver, "/a.txt", 0); content != "hello world" {
+		t.Errorf("got %q after append", content)
+	}
+	if content := readMemFile(t, driver, "/a.txt", 6); content != "world" {
+		t.Errorf("got %q from offset 6", content)
+	}
+	if _, _, err := driver.GetFile("/a.txt", 12); err == nil {
+		t.Error("expected an error for an offset past the end")
+	}
+	if _, err := driver.PutFileAt("/a.txt", 12, strings.NewReader("!")); err == nil {
+		t.Error("expected an error resuming past the end")
+	}
+	if _, err := driver.PutFileAt("/a.txt", 6, strings.NewReader("there")); err != nil {
+		t.Fatal(err)
+	}
+	if content := readMemFile(t, driver, "/a.txt", 0); content != "hello there" {
+		t.Errorf("got %q after resuming at offset 6", content)
+	}
+	if _, err := driver.PutFileAt("/a.txt", 6, strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := driver.Stat("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "a.txt" || info.Size() != 11 || info.IsDir() || info.Owner() != "alice" || info.Group() != "group" {
+		t.Errorf("unexpected file info %s %d %v %s %s", info.Name(), info.Size(), info.IsDir(), info.Owner(), info.Group())
+	}
+
+	if err := driver.MakeDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.MakeDir("/dir"); !errors.Is(err, ErrFileExists) {
+		t.Errorf("expected ErrFileExists, got %v", err)
+	}
+	if err := driver.Rename("/a.txt", "/dir/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Rename("/moved", "/moved/sub"); err == nil {
+		t.Error("expected an error moving a directory into itself")
+	}
+	if names := listMemDir(t, driver, "/"); names != "moved" {
+		t.Errorf("got %q in /", names)
+	}
+	if content := readMemFile(t, driver, "/moved/b.txt", 0); content != "hello world" {
+		t.Errorf("got %q after renames", content)
+	}
+
+	if err := driver.DeleteDir("/moved"); err == nil {
+		t.Error("expected an error deleting a directory that is not empty")
+	}
+	if err := driver.DeleteFile("/moved/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.DeleteDir("/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat("/moved"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := driver.PutFile("/missing/c.txt", strings.NewReader("x"), false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemDriverPerm(t *testing.T) {
+	driver := newMemDriver(t)
+	if _, err := driver.PutFile("/a.txt", strings.NewReader("a"), false); err != nil {
+		t.Fatal(err)
+	}
+	driver.ChOwner("/a.txt", "bob")
+	driver.ChGroup("/a.txt", "staff")
+	driver.ChMode("/a.txt", 0600)
+
+	owner, _ := driver.GetOwner("/a.txt")
+	group, _ := driver.GetGroup("/a.txt")
+	mode, _ := driver.GetMode("/a.txt")
+	if owner != "bob" || group != "staff" || mode != 0600 {
+		t.Errorf("got %s %s %v", owner, group, mode)
+	}
+}
+
+func TestMemDriverConcurrent(t *testing.T) {
+	factory := NewMemDriverFactory("owner", "group")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			driver, _ := factory.NewDriver()
+			name := fmt.Sprintf("/file%d", i)
+			for j := 0; j < 100; j++ {
+				driver.PutFile(name, strings.NewReader("x"), true)
+				driver.PutFile("/shared", strings.NewReader("y"), true)
+				driver.ListDir("/", func(FileInfo) error { return nil })
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	driver, _ := factory.NewDriver()
+	info, err := driver.Stat("/shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1000 {
+		t.Errorf("got %d bytes in /shared, want 1000", info.Size())
+	}
+}
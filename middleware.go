@@ -0,0 +1,55 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+// CommandHandler handles a command received from the client. command is
+// the upper cased name of the command and param its parameter. The
+// handler is responsible for replying to the client.
+type CommandHandler func(conn *Conn, command string, param string)
+
+// Middleware wraps the handling of every command received by the server,
+// for example to audit, rate limit or time them. It returns a handler that
+// may reply to the client itself instead of calling next, or call next to
+// run the registered Command.
+//
+// The session and user are available through conn.SessionID() and
+// conn.LoginUser().
+type Middleware func(next CommandHandler) CommandHandler
+
+// chainMiddlewares wraps handler with middlewares, the first one being the
+// outermost.
+func chainMiddlewares(handler CommandHandler, middlewares []Middleware) CommandHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// executeCommand is the innermost CommandHandler, it runs the Command
+// registered on the server under command.
+func executeCommand(conn *Conn, command string, param string) {
+	cmdObj, _ := conn.server.LookupCommand(command)
+	if cmdObj == nil {
+		conn.writeMessage(500, "Command not found")
+		return
+	}
+	if !conn.commandEnabled(command) {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+	if cmdObj.RequireAuth() && conn.user == "" {
+		conn.writeMessage(530, "not logged in")
+		return
+	}
+	if !conn.checkSequence(sequenceName(command, param)) {
+		return
+	}
+	conn.leaveState(sequenceName(command, param))
+	if cmdObj.RequireParam() && param == "" {
+		conn.writeMessage(553, "action aborted, required param missing")
+	} else {
+		cmdObj.Execute(conn, param)
+	}
+}
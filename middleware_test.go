@@ -0,0 +1,49 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMiddlewares(t *testing.T) {
+	var audit []string
+	auditor := func(next CommandHandler) CommandHandler {
+		return func(conn *Conn, command string, param string) {
+			audit = append(audit, conn.LoginUser()+" "+command+" "+param)
+			next(conn, command, param)
+		}
+	}
+	denyDele := func(next CommandHandler) CommandHandler {
+		return func(conn *Conn, command string, param string) {
+			if command == "DELE" && conn.LoginUser() == "guest" {
+				conn.Reply(550, "Permission denied")
+				return
+			}
+			next(conn, command, param)
+		}
+	}
+
+	c, replies := newTestConn(nil)
+	defer c.Close()
+	c.user = "guest"
+	c.server = NewServer(&ServerOpts{
+		Logger:      &DiscardLogger{},
+		Middlewares: []Middleware{auditor, denyDele},
+	})
+
+	done := sendCommand(c, "dele file\r\n")
+	expectReply(t, replies, "550 Permission denied")
+	<-done
+	done = sendCommand(c, "NOOP\r\n")
+	expectReply(t, replies, "200")
+	<-done
+
+	expected := "guest DELE file\nguest NOOP "
+	if strings.Join(audit, "\n") != expected {
+		t.Errorf("expected audit %q, got %q", expected, strings.Join(audit, "\n"))
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MountDriverFactory creates drivers composing the drivers of several
+// factories in a single tree, each one being mounted at a path. The
+// parents of the mount points that are not served by a driver mounted at
+// "/" are read-only directories.
+type MountDriverFactory struct {
+	// The factories of the mounted drivers by mount point, such as
+	// "/incoming". Mandatory.
+	Mounts map[string]DriverFactory
+
+	// If true a file renamed to another mount is copied then deleted,
+	// otherwise such renames fail with ErrPermission.
+	CopyAcrossMounts bool
+
+	// The owner and group of the directories that are not in any mount.
+	// Optional.
+	Owner string
+	Group string
+}
+
+// NewDriver returns a driver for a new session, with a new driver from
+// each of the mounted factories.
+func (factory *MountDriverFactory) NewDriver() (Driver, error) {
+	driver := &MountDriver{
+		copyAcross: factory.CopyAcrossMounts,
+		owner:      factory.Owner,
+		group:      factory.Group,
+		modTime:    time.Now(),
+	}
+	for mountPoint, mountFactory := range factory.Mounts {
+		child, err := mountFactory.NewDriver()
+		if err != nil {
+			return nil, fmt.Errorf("mount %s: %v", mountPoint, err)
+		}
+		driver.mounts = append(driver.mounts, mount{path.Clean("/" + mountPoint), child})
+	}
+	// longest mount points first, so that the first match is the deepest
+	sort.Slice(driver.mounts, func(i, j int) bool {
+		return len(driver.mounts[i].path) > len(driver.mounts[j].path)
+	})
+	return driver, nil
+}
+
+type mount struct {
+	path   string
+	driver Driver
+}
+
+// MountDriver is the Driver of a session on the tree of a
+// MountDriverFactory. It also implements CopyDriver, Perm, TimesDriver,
+// RestartDriver and TruncateDriver, failing with ErrNotSupported on the
+// mounts whose driver does not; the server only uses them where it does.
+type MountDriver struct {
+	mounts     []mount
+	copyAcross bool
+	owner      string
+	group      string
+	modTime    time.Time
+}
+
+// resolve returns the mount serving name and the path of name within it.
+func (driver *MountDriver) resolve(name string) (*mount, string, bool) {
+	name = path.Clean("/" + name)
+	for i, m := range driver.mounts {
+		if m.path == "/" {
+			return &driver.mounts[i], name, true
+		}
+		if name == m.path {
+			return &driver.mounts[i], "/", true
+		}
+		if strings.HasPrefix(name, m.path+"/") {
+			return &driver.mounts[i], strings.TrimPrefix(name, m.path), true
+		}
+	}
+	return nil, "", false
+}
+
+// implements reports whether the driver of the mount serving name passes
+// probe, or, if name is empty, whether the driver of any mount does.
+func (driver *MountDriver) implements(name string, probe func(interface{}) bool) bool {
+	if name == "" {
+		for _, m := range driver.mounts {
+			if probe(m.driver) {
+				return true
+			}
+		}
+		return false
+	}
+	m, _, ok := driver.resolve(name)
+	return ok && probe(m.driver)
+}
+
+// isMountPoint reports whether a driver is mounted at name, other than at
+// the root.
+func (driver *MountDriver) isMountPoint(name string) bool {
+	name = path.Clean("/" + name)
+	for _, m := range driver.mounts {
+		if m.path == name && name != "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// isVirtualDir reports whether name is a parent of a mount point.
+func (driver *MountDriver) isVirtualDir(name string) bool {
+	name = path.Clean("/" + name)
+	for _, m := range driver.mounts {
+		if name == "/" || strings.HasPrefix(m.path, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// virtualDir returns the FileInfo of a directory that is not in a mount.
+func (driver *MountDriver) virtualDir(name string) FileInfo {
+	return &memFileInfo{path.Base(name), memFile{
+		mode:    os.ModeDir | 0555,
+		modTime: driver.modTime,
+		owner:   driver.owner,
+		group:   driver.group,
+	}}
+}
+
+// mountInfo renames the FileInfo of the root of a mount after its mount
+// point.
+type mountInfo struct {
+	FileInfo
+	name string
+}
+
+func (f mountInfo) Name() string {
+	return f.name
+}
+
+// mutable returns the mount serving name, failing with ErrPermission if
+// name is not in a mount or is a mount point.
+func (driver *MountDriver) mutable(name string) (*mount, string, error) {
+	m, childPath, ok := driver.resolve(name)
+	if !ok || driver.isMountPoint(name) {
+		return nil, "", fmt.Errorf("%s: %w", name, ErrPermission)
+	}
+	return m, childPath, nil
+}
+
+func (driver *MountDriver) Init(conn *Conn) {
+	for _, m := range driver.mounts {
+		m.driver.Init(conn)
+	}
+}
+
+func (driver *MountDriver) Stat(name string) (FileInfo, error) {
+	name = path.Clean("/" + name)
+	m, childPath, ok := driver.resolve(name)
+	if ok {
+		info, err := m.driver.Stat(childPath)
+		if err == nil {
+			if driver.isMountPoint(name) {
+				return mountInfo{info, path.Base(name)}, nil
+			}
+			return info, nil
+		}
+		if !driver.isVirtualDir(name) {
+			return nil, err
+		}
+	}
+	if driver.isVirtualDir(name) {
+		return driver.virtualDir(name), nil
+	}
+	return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+}
+
+func (driver *MountDriver) ChangeDir(name string) error {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", name)
+	}
+	return nil
+}
+
+// ListDir lists the files of the mount serving name, if any, along with
+// the mount points and their parents found directly in name.
+func (driver *MountDriver) ListDir(name string, callback func(FileInfo) error) error {
+	name = path.Clean("/" + name)
+	prefix := name
+	if prefix != "/" {
+		prefix += "/"
+	}
+	dirs := map[string]bool{}
+	for _, m := range driver.mounts {
+		if m.path != "/" && strings.HasPrefix(m.path, prefix) {
+			dirs[strings.SplitN(m.path[len(prefix):], "/", 2)[0]] = true
+		}
+	}
+
+	if m, childPath, ok := driver.resolve(name); ok {
+		err := m.driver.ListDir(childPath, func(f FileInfo) error {
+			if dirs[f.Name()] {
+				return nil
+			}
+			return callback(f)
+		})
+		if err != nil && !driver.isVirtualDir(name) {
+			return err
+		}
+	} else if !driver.isVirtualDir(name) {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	for _, dir := range names {
+		info, err := driver.Stat(path.Join(name, dir))
+		if err != nil {
+			continue
+		}
+		if err := callback(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *MountDriver) DeleteDir(name string) error {
+	m, childPath, err := driver.mutable(name)
+	if err != nil {
+		return err
+	}
+	return m.driver.DeleteDir(childPath)
+}
+
+func (driver *MountDriver) DeleteFile(name string) error {
+	m, childPath, err := driver.mutable(name)
+	if err != nil {
+		return err
+	}
+	return m.driver.DeleteFile(childPath)
+}
+
+// Rename renames a file within a mount, or copies it to another mount then
+// deletes it if CopyAcrossMounts is set. Directories cannot be moved to
+// another mount.
+func (driver *MountDriver) Rename(fromPath string, toPath string) error {
+	from, fromChild, err := driver.mutable(fromPath)
+	if err != nil {
+		return err
+	}
+	to, toChild, err := driver.mutable(toPath)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return from.driver.Rename(fromChild, toChild)
+	}
+	if !driver.copyAcross {
+		return fmt.Errorf("%s: rename across mounts: %w", fromPath, ErrPermission)
+	}
+
+	info, err := from.driver.Stat(fromChild)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: cannot move a directory across mounts: %w", fromPath, ErrPermission)
+	}
+	_, data, err := from.driver.GetFile(fromChild, 0)
+	if err != nil {
+		return err
+	}
+	_, err = to.driver.PutFile(toChild, data, false)
+	data.Close()
+	if err != nil {
+		return err
+	}
+	return from.driver.DeleteFile(fromChild)
+}
+
+func (driver *MountDriver) MakeDir(name string) error {
+	m, childPath, err := driver.mutable(name)
+	if err != nil {
+		return err
+	}
+	return m.driver.MakeDir(childPath)
+}
+
+func (driver *MountDriver) GetFile(name string, offset int64) (int64, io.ReadCloser, error) {
+	m, childPath, ok := driver.resolve(name)
+	if !ok {
+		return 0, nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return m.driver.GetFile(childPath, offset)
+}
+
+func (driver *MountDriver) PutFile(name string, data io.Reader, appendData bool) (int64, error) {
+	m, childPath, err := driver.mutable(name)
+	if err != nil {
+		return 0, err
+	}
+	return m.driver.PutFile(childPath, data, appendData)
+}
+
+// PutFileAt resumes an upload if the mount serving name implements
+// RestartDriver.
+func (driver *MountDriver) PutFileAt(name string, offset int64, data io.Reader) (int64, error) {
+	m, childPath, err := driver.mutable(name)
+	if err != nil {
+		return 0, err
+	}
+	restart, ok := m.driver.(RestartDriver)
+	if !ok {
+		return 0, fmt.Errorf("%s: cannot resume uploads: %w", name, ErrNotSupported)
+	}
+	return restart.PutFileAt(childPath, offset, data)
+}
+
+// CopyFile copies a file with the CopyDriver of its mount if it has one,
+// and through GetFile and PutFile otherwise, or to another mount.
+func (driver *MountDriver) CopyFile(fromPath string, toPath string) error {
+	from, fromChild, ok := driver.resolve(fromPath)
+	if !ok {
+		return fmt.Errorf("%s: %w", fromPath, ErrNotFound)
+	}
+	to, toChild, err := driver.mutable(toPath)
+	if err != nil {
+		return err
+	}
+	if copier, ok := from.driver.(CopyDriver); ok && from == to {
+		return copier.CopyFile(fromChild, toChild)
+	}
+	_, data, err := from.driver.GetFile(fromChild, 0)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	_, err = to.driver.PutFile(toChild, data, false)
+	return err
+}
+
+// Truncate truncates a file if its mount implements TruncateDriver.
+func (driver *MountDriver) Truncate(name string, size int64) error {
+	m, childPath, err := driver.mutable(name)
+	if err != nil {
+		return err
+	}
+	truncater, ok := m.driver.(TruncateDriver)
+	if !ok {
+		return fmt.Errorf("%s: cannot truncate: %w", name, ErrNotSupported)
+	}
+	return truncater.Truncate(childPath, size)
+}
+
+// perm returns the Perm of the mount serving name.
+func (driver *MountDriver) perm(name string) (Perm, string, error) {
+	m, childPath, ok := driver.resolve(name)
+	if !ok {
+		return nil, "", fmt.Errorf("%s: %w", name, ErrPermission)
+	}
+	perm, ok := m.driver.(Perm)
+	if !ok {
+		return nil, "", fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	return perm, childPath, nil
+}
+
+func (driver *MountDriver) GetOwner(name string) (string, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return info.Owner(), nil
+}
+
+func (driver *MountDriver) GetGroup(name string) (string, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return info.Group(), nil
+}
+
+func (driver *MountDriver) GetMode(name string) (os.FileMode, error) {
+	info, err := driver.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Mode(), nil
+}
+
+func (driver *MountDriver) ChOwner(name string, owner string) error {
+	perm, childPath, err := driver.perm(name)
+	if err != nil {
+		return err
+	}
+	return perm.ChOwner(childPath, owner)
+}
+
+func (driver *MountDriver) ChGroup(name string, group string) error {
+	perm, childPath, err := driver.perm(name)
+	if err != nil {
+		return err
+	}
+	return perm.ChGroup(childPath, group)
+}
+
+func (driver *MountDriver) ChMode(name string, mode os.FileMode) error {
+	perm, childPath, err := driver.perm(name)
+	if err != nil {
+		return err
+	}
+	return perm.ChMode(childPath, mode)
+}
+
+func (driver *MountDriver) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	m, childPath, ok := driver.resolve(name)
+	if !ok {
+		return fmt.Errorf("%s: %w", name, ErrPermission)
+	}
+	times, ok := m.driver.(TimesDriver)
+	if !ok {
+		return fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	return times.SetTimes(childPath, atime, mtime, ctime)
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newMountDriver(t *testing.T, copyAcross bool) (Driver, *MemDriverFactory) {
+	t.Helper()
+	incoming := NewMemDriverFactory("ftp", "ftp")
+	factory := &MountDriverFactory{
+		Mounts: map[string]DriverFactory{
+			"/incoming": incoming,
+			"/outgoing": NewMemDriverFactory("ftp", "ftp"),
+			"/data/archive": &FSDriverFactory{FS: fstest.MapFS{
+				"2018/report.txt": &fstest.MapFile{Data: []byte("report")},
+			}},
+		},
+		CopyAcrossMounts: copyAcross,
+	}
+	driver, err := factory.NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.Init(&Conn{})
+	return driver, incoming
+}
+
+func TestMountDriver(t *testing.T) {
+	driver, incoming := newMountDriver(t, false)
+
+	var listTests = []struct {
+		dir   string
+		names string
+	}{
+		{"/", "data incoming outgoing"},
+		{"/data", "archive"},
+		{"/data/archive", "2018"},
+		{"/data/archive/2018", "report.txt"},
+		{"/incoming", ""},
+	}
+	for _, tt := range listTests {
+		if names := listMemDir(t, driver, tt.dir); names != tt.names {
+			t.Errorf("ListDir(%s) = %q, want %q", tt.dir, names, tt.names)
+		}
+	}
+
+	for _, dir := range []string{"/", "/data", "/data/archive", "/incoming"} {
+		if err := driver.ChangeDir(dir); err != nil {
+			t.Errorf("ChangeDir(%s): %v", dir, err)
+		}
+	}
+	if info, err := driver.Stat("/data/archive"); err != nil || info.Name() != "archive" || !info.IsDir() {
+		t.Errorf("unexpected Stat of a mount point %v, %v", info, err)
+	}
+	if _, err := driver.Stat("/nowhere"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if _, err := driver.PutFile("/incoming/a.txt", strings.NewReader("a"), false); err != nil {
+		t.Fatal(err)
+	}
+	inner, _ := incoming.NewDriver()
+	if got := readMemFile(t, inner, "/a.txt", 0); got != "a" {
+		t.Errorf("got %q in the mounted driver", got)
+	}
+	if got := readMemFile(t, driver, "/data/archive/2018/report.txt", 2); got != "port" {
+		t.Errorf("got %q from the read-only mount", got)
+	}
+
+	var refused = []error{
+		driver.MakeDir("/data/new"),
+		driver.DeleteDir("/incoming"),
+		driver.DeleteFile("/data/archive/2018/report.txt"),
+		driver.Rename("/incoming/a.txt", "/data/archive/a.txt"),
+	}
+	for _, err := range refused {
+		if !errors.Is(err, ErrPermission) {
+			t.Errorf("expected ErrPermission, got %v", err)
+		}
+	}
+
+	if err := driver.Rename("/incoming/a.txt", "/incoming/b.txt"); err != nil {
+		t.Errorf("Rename within a mount: %v", err)
+	}
+}
+
+func TestMountDriverCopyAcross(t *testing.T) {
+	driver, _ := newMountDriver(t, true)
+
+	if _, err := driver.PutFile("/incoming/a.txt", strings.NewReader("moved"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Rename("/incoming/a.txt", "/outgoing/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, driver, "/outgoing/a.txt", 0); got != "moved" {
+		t.Errorf("got %q after the copy", got)
+	}
+	if _, err := driver.Stat("/incoming/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the source to be deleted, got %v", err)
+	}
+	if err := driver.Rename("/incoming/a.txt", "/data/archive/a.txt"); err == nil {
+		t.Error("expected an error copying to a read-only mount")
+	}
+}
+
+// plainFactory creates drivers without any of the optional interfaces.
+type plainFactory struct {
+	DriverFactory
+}
+
+func (factory plainFactory) NewDriver() (Driver, error) {
+	driver, err := factory.DriverFactory.NewDriver()
+	return struct{ Driver }{driver}, err
+}
+
+func TestMountDriverUnsupported(t *testing.T) {
+	factory := &MountDriverFactory{
+		Mounts: map[string]DriverFactory{
+			"/plain": plainFactory{NewMemDriverFactory("ftp", "ftp")},
+		},
+	}
+	driver, err := factory.NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.Init(&Conn{})
+	if _, err := driver.PutFile("/plain/file", strings.NewReader("0123"), false); err != nil {
+		t.Fatal(err)
+	}
+	c, replies := newTestConn(driver)
+	defer c.Close()
+
+	done := sendCommand(c, "FEAT\r\n")
+	if feat := readMultiline(t, replies); strings.Contains(feat, "MFMT") {
+		t.Errorf("MFMT advertised without TimesDriver:\n%s", feat)
+	}
+	<-done
+	for _, line := range []string{"SITE CHMOD 644 /plain/file", "SITE UTIME 20180101000000 /plain/file", "MFMT 20180101000000 /plain/file"} {
+		done = sendCommand(c, line+"\r\n")
+		expectReply(t, replies, "502")
+		<-done
+	}
+
+	// the upload is resumed by appending to the file
+	done = sendCommand(c, "REST 4\r\n")
+	expectReply(t, replies, "350")
+	<-done
+	client, server := net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "STOR /plain/file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	client.Write([]byte("45"))
+	client.Close()
+	expectReply(t, replies, "226")
+	if got := readMemFile(t, driver, "/plain/file", 0); got != "012345" {
+		t.Errorf("got %q after resuming", got)
+	}
+
+	done = sendCommand(c, "REST 2\r\n")
+	expectReply(t, replies, "350")
+	<-done
+	client, server = net.Pipe()
+	defer client.Close()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "STOR /plain/file\r\n")
+	expectReply(t, replies, "554")
+	<-done
+}
+
+func TestMountDriverPartlySupported(t *testing.T) {
+	driver, _ := newMountDriver(t, false)
+	c, replies := newTestConn(driver)
+	defer c.Close()
+
+	// the times of the read-only mount cannot be set, unlike the others
+	done := sendCommand(c, "MFMT 20180101000000 /data/archive/2018/report.txt\r\n")
+	expectReply(t, replies, "504")
+	<-done
+	if err := driver.(*MountDriver).Truncate("/data/archive/2018/report.txt", 0); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// Quota is the storage a user may use. A zero value means no limit.
+type Quota struct {
+	// The total size of the files of the user, in bytes.
+	MaxBytes int64
+
+	// The number of files and directories of the user.
+	MaxFiles int64
+}
+
+// Usage is the storage used by a user.
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// QuotaStore persists the usage of the users across restarts.
+type QuotaStore interface {
+	// LoadUsage returns the usage saved for user, or an error wrapping
+	// ErrNotFound if there is none yet.
+	LoadUsage(user string) (Usage, error)
+
+	// SaveUsage is called each time the usage of user changed.
+	SaveUsage(user string, usage Usage) error
+}
+
+// QuotaManager enforces per-user quotas in front of the drivers: uploads,
+// new directories and deletions are accounted to the logged in user, and
+// those going over their quota fail with ErrQuotaExceeded. The usage of a
+// user is loaded from the Store the first time it is needed, or computed
+// by listing all the files of their driver if there is no Store or it does
+// not know the user yet.
+//
+// The usage is shared by the sessions of a user, so a QuotaManager should
+// be used by a single Server, set in ServerOpts.Quota.
+type QuotaManager struct {
+	// Limit returns the quota of a user. Mandatory.
+	Limit func(user string) Quota
+
+	// The persisted usage. Optional.
+	Store QuotaStore
+
+	lock  sync.Mutex // protects usage
+	usage map[string]*Usage
+}
+
+// load makes sure the usage of user is known, using driver to compute it.
+func (manager *QuotaManager) load(ctx context.Context, user string, driver DriverV2) error {
+	manager.lock.Lock()
+	_, ok := manager.usage[user]
+	manager.lock.Unlock()
+	if ok {
+		return nil
+	}
+
+	var usage Usage
+	var err error
+	if manager.Store != nil {
+		usage, err = manager.Store.LoadUsage(user)
+	}
+	if manager.Store == nil || errors.Is(err, ErrNotFound) {
+		usage = Usage{}
+		err = walkUsage(ctx, driver, "/", &usage)
+		if err == nil && manager.Store != nil {
+			err = manager.Store.SaveUsage(user, usage)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.usage == nil {
+		manager.usage = make(map[string]*Usage)
+	}
+	if _, ok := manager.usage[user]; !ok {
+		manager.usage[user] = &usage
+	}
+	return nil
+}
+
+// walkUsage adds the files found in dir and its subdirectories to usage.
+func walkUsage(ctx context.Context, driver DriverV2, dir string, usage *Usage) error {
+	var dirs []string
+	err := driver.ListDir(ctx, dir, func(f FileInfo) error {
+		usage.Files++
+		if f.IsDir() {
+			dirs = append(dirs, path.Join(dir, f.Name()))
+		} else {
+			usage.Bytes += f.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, sub := range dirs {
+		if err := walkUsage(ctx, driver, sub, usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update calls change with the usage and quota of user, then saves the
+// usage unless change failed. The usage must have been loaded.
+func (manager *QuotaManager) update(user string, change func(*Usage, Quota) error) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	usage := manager.usage[user]
+	if err := change(usage, manager.Limit(user)); err != nil {
+		return err
+	}
+	if manager.Store != nil {
+		return manager.Store.SaveUsage(user, *usage)
+	}
+	return nil
+}
+
+// get returns the usage and quota of user. The usage must have been
+// loaded.
+func (manager *QuotaManager) get(user string) (Usage, Quota) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return *manager.usage[user], manager.Limit(user)
+}
+
+// quotaDriver is the DriverV2 accounting the changes of a session to the
+// QuotaManager of the server.
+type quotaDriver struct {
+	DriverV2
+	manager *QuotaManager
+	conn    *Conn
+}
+
+// usage returns the usage and quota of the logged in user.
+func (driver *quotaDriver) usage(ctx context.Context) (Usage, Quota, error) {
+	user := driver.conn.LoginUser()
+	if err := driver.manager.load(ctx, user, driver.DriverV2); err != nil {
+		return Usage{}, Quota{}, err
+	}
+	usage, quota := driver.manager.get(user)
+	return usage, quota, nil
+}
+
+// update loads the usage of the logged in user then calls
+// QuotaManager.update.
+func (driver *quotaDriver) update(ctx context.Context, change func(*Usage, Quota) error) error {
+	user := driver.conn.LoginUser()
+	if err := driver.manager.load(ctx, user, driver.DriverV2); err != nil {
+		return err
+	}
+	return driver.manager.update(user, change)
+}
+
+// addFile reserves an entry for a new file or directory.
+func addFile(usage *Usage, quota Quota) error {
+	if quota.MaxFiles > 0 && usage.Files >= quota.MaxFiles {
+		return ErrQuotaExceeded
+	}
+	usage.Files++
+	return nil
+}
+
+func (driver *quotaDriver) DeleteDir(ctx context.Context, name string) error {
+	if err := driver.DriverV2.DeleteDir(ctx, name); err != nil {
+		return err
+	}
+	return driver.update(ctx, func(usage *Usage, quota Quota) error {
+		usage.Files--
+		return nil
+	})
+}
+
+func (driver *quotaDriver) DeleteFile(ctx context.Context, name string) error {
+	info, err := driver.DriverV2.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := driver.DriverV2.DeleteFile(ctx, name); err != nil {
+		return err
+	}
+	return driver.update(ctx, func(usage *Usage, quota Quota) error {
+		usage.Bytes -= info.Size()
+		usage.Files--
+		return nil
+	})
+}
+
+// Rename frees the space of the file replaced by toPath, if any.
+func (driver *quotaDriver) Rename(ctx context.Context, fromPath string, toPath string) error {
+	replaced, err := driver.DriverV2.Stat(ctx, toPath)
+	if err != nil || replaced.IsDir() {
+		replaced = nil
+	}
+	if err := driver.DriverV2.Rename(ctx, fromPath, toPath); err != nil {
+		return err
+	}
+	if replaced == nil {
+		return nil
+	}
+	return driver.update(ctx, func(usage *Usage, quota Quota) error {
+		usage.Bytes -= replaced.Size()
+		usage.Files--
+		return nil
+	})
+}
+
+func (driver *quotaDriver) MakeDir(ctx context.Context, name string) error {
+	if err := driver.update(ctx, addFile); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	err := driver.DriverV2.MakeDir(ctx, name)
+	if err != nil {
+		driver.update(ctx, func(usage *Usage, quota Quota) error {
+			usage.Files--
+			return nil
+		})
+	}
+	return err
+}
+
+// PutFile stores the data until the quota of the user is reached, then
+// fails with ErrQuotaExceeded.
+func (driver *quotaDriver) PutFile(ctx context.Context, name string, data io.Reader, appendData bool) (int64, error) {
+	return driver.store(ctx, name, data, func(old FileInfo) int64 {
+		if appendData {
+			return 0
+		}
+		return old.Size()
+	}, func(data io.Reader) (int64, error) {
+		return driver.DriverV2.PutFile(ctx, name, data, appendData)
+	})
+}
+
+// putFileAt resumes an upload with putFileAt, the data after offset being
+// replaced.
+func (driver *quotaDriver) putFileAt(ctx context.Context, putFileAt putFileAtFunc, name string, offset int64, data io.Reader) (int64, error) {
+	return driver.store(ctx, name, data, func(old FileInfo) int64 {
+		if old.Size() > offset {
+			return old.Size() - offset
+		}
+		return 0
+	}, func(data io.Reader) (int64, error) {
+		return putFileAt(ctx, name, offset, data)
+	})
+}
+
+// store calls put to store data in name, freed returning how many bytes of
+// the existing file are replaced. The usage is charged while the data is
+// received, so that concurrent uploads cannot exceed the quota either, and
+// set to the actual size of the file once it is stored.
+func (driver *quotaDriver) store(ctx context.Context, name string, data io.Reader, freed func(FileInfo) int64, put func(io.Reader) (int64, error)) (int64, error) {
+	if _, _, err := driver.usage(ctx); err != nil {
+		return 0, err
+	}
+	old, err := driver.DriverV2.Stat(ctx, name)
+	if err != nil {
+		old = nil
+		if err := driver.update(ctx, addFile); err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	reader := &quotaReader{Reader: data, driver: driver}
+	if old != nil {
+		reader.freed = freed(old)
+	}
+	bytes, err := put(reader)
+
+	// ctx is cancelled if the transfer was aborted
+	stored, statErr := driver.DriverV2.Stat(context.Background(), name)
+	driver.manager.update(driver.conn.LoginUser(), func(usage *Usage, quota Quota) error {
+		usage.Bytes -= reader.charged
+		if old != nil {
+			usage.Bytes -= old.Size()
+		}
+		if statErr == nil {
+			usage.Bytes += stored.Size()
+		} else {
+			usage.Files--
+		}
+		return nil
+	})
+	if reader.exceeded {
+		return bytes, fmt.Errorf("%s: %w", name, ErrQuotaExceeded)
+	}
+	return bytes, err
+}
+
+// account runs op, which changes the file at name through an optional
+// interface of the driver, then charges the change in size to the user.
+// op is refused beforehand if the file would have to grow by need bytes
+// beyond the quota, or be created beyond the file quota.
+func (driver *quotaDriver) account(ctx context.Context, name string, need int64, op func() error) error {
+	if _, _, err := driver.usage(ctx); err != nil {
+		return err
+	}
+	old, err := driver.DriverV2.Stat(ctx, name)
+	if err != nil {
+		old = nil
+	}
+	err = driver.update(ctx, func(usage *Usage, quota Quota) error {
+		if old == nil && quota.MaxFiles > 0 && usage.Files >= quota.MaxFiles {
+			return ErrQuotaExceeded
+		}
+		if old != nil {
+			need -= old.Size()
+		}
+		if need > 0 && quota.MaxBytes > 0 && usage.Bytes+need > quota.MaxBytes {
+			return ErrQuotaExceeded
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	err = op()
+	changed, statErr := driver.DriverV2.Stat(context.Background(), name)
+	driver.update(ctx, func(usage *Usage, quota Quota) error {
+		if old != nil {
+			usage.Bytes -= old.Size()
+			usage.Files--
+		}
+		if statErr == nil {
+			usage.Bytes += changed.Size()
+			usage.Files++
+		}
+		return nil
+	})
+	return err
+}
+
+// quotaReader charges the data read to the usage of the user, failing with
+// ErrQuotaExceeded once the quota is reached.
+type quotaReader struct {
+	io.Reader
+	driver   *quotaDriver
+	freed    int64 // the bytes of the file being replaced
+	charged  int64
+	exceeded bool
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := r.Reader.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+	// not saved to the store before the upload ends
+	manager, user := r.driver.manager, r.driver.conn.LoginUser()
+	manager.lock.Lock()
+	usage, quota := manager.usage[user], manager.Limit(user)
+	if quota.MaxBytes > 0 {
+		if avail := quota.MaxBytes - usage.Bytes + r.freed; int64(n) > avail {
+			n = 0
+			if avail > 0 {
+				n = int(avail)
+			}
+			r.exceeded = true
+		}
+	}
+	usage.Bytes += int64(n)
+	r.charged += int64(n)
+	manager.lock.Unlock()
+	if r.exceeded {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
+
+// commandAvbl responds to the AVBL FTP command with the number of bytes the
+// user may still store: the smaller of what is left of their quota and of
+// the free storage reported by a StatFSDriver.
+type commandAvbl struct{}
+
+func (cmd commandAvbl) IsExtend() bool {
+	return false
+}
+
+func (cmd commandAvbl) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAvbl) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAvbl) Execute(conn *Conn, param string) {
+	avail := int64(-1)
+	if conn.quota != nil {
+		usage, quota, err := conn.quota.usage(conn.Context())
+		if err != nil {
+			conn.replyError(550, err)
+			return
+		}
+		if quota.MaxBytes > 0 {
+			avail = quota.MaxBytes - usage.Bytes
+			if avail < 0 {
+				avail = 0
+			}
+		}
+	}
+	if driver, ok := unwrapDriver(conn.driver).(StatFSDriver); ok {
+		free, err := driver.StatFS(conn.buildPath(param))
+		if err != nil {
+			conn.replyError(550, err)
+			return
+		}
+		if avail < 0 || free < avail {
+			avail = free
+		}
+	}
+	if avail < 0 {
+		conn.writeMessage(550, "Available space unknown")
+		return
+	}
+	conn.writeMessage(213, strconv.FormatInt(avail, 10))
+}
+
+// siteQuota responds to SITE QUOTA by describing the quota and usage of the
+// user.
+type siteQuota struct{}
+
+func (cmd siteQuota) IsExtend() bool {
+	return false
+}
+
+func (cmd siteQuota) RequireParam() bool {
+	return false
+}
+
+func (cmd siteQuota) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteQuota) available(conn *Conn) bool {
+	return conn.quota != nil
+}
+
+func (cmd siteQuota) Execute(conn *Conn, param string) {
+	if conn.quota == nil {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+	usage, quota, err := conn.quota.usage(conn.Context())
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	limit := func(n int64) string {
+		if n <= 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	conn.writeMessageMultiline(200, fmt.Sprintf("Quota for %s:\n Bytes used: %d of %s\n Files used: %d of %s",
+		conn.LoginUser(), usage.Bytes, limit(quota.MaxBytes), usage.Files, limit(quota.MaxFiles)))
+}
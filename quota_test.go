@@ -0,0 +1,195 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memQuotaStore is a QuotaStore keeping the usage in a map.
+type memQuotaStore struct {
+	lock  sync.Mutex
+	usage map[string]Usage
+}
+
+func (s *memQuotaStore) LoadUsage(user string) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	usage, ok := s.usage[user]
+	if !ok {
+		return Usage{}, ErrNotFound
+	}
+	return usage, nil
+}
+
+func (s *memQuotaStore) SaveUsage(user string, usage Usage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.usage[user] = usage
+	return nil
+}
+
+func TestQuota(t *testing.T) {
+	factory := NewMemDriverFactory("ftp", "ftp")
+	driver, _ := factory.NewDriver()
+	driver.Init(&Conn{})
+	if _, err := driver.PutFile("/a.txt", strings.NewReader("abcd"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memQuotaStore{usage: map[string]Usage{}}
+	c, replies := newTestConn(driver)
+	defer c.Close()
+	c.user = ""
+	c.server = NewServer(&ServerOpts{
+		Logger: &DiscardLogger{},
+		Auth:   &SimpleAuth{Name: "alice", Password: "secret"},
+		Quota: &QuotaManager{
+			Limit: func(user string) Quota {
+				return Quota{MaxBytes: 10, MaxFiles: 3}
+			},
+			Store: store,
+		},
+	})
+
+	send := func(line string) string {
+		done := sendCommand(c, line+"\r\n")
+		reply := readMultiline(t, replies)
+		<-done
+		return reply
+	}
+	send("USER alice")
+	send("PASS secret")
+	if reply := send("AVBL"); reply != "213 6" {
+		t.Errorf("AVBL: got %q", reply)
+	}
+
+	stor := func(name, data, reply string) {
+		client, server := net.Pipe()
+		c.dataConn = pipeSocket{server}
+		done := sendCommand(c, "STOR "+name+"\r\n")
+		expectReply(t, replies, "150")
+		<-done
+		go func() {
+			client.Write([]byte(data))
+			client.Close()
+		}()
+		expectReply(t, replies, reply)
+	}
+	stor("b.txt", "012345", "226")
+	stor("c.txt", "0123456789", "552")
+
+	var quotaTests = []struct {
+		line  string
+		reply string
+	}{
+		{"AVBL", "213 0"},
+		{"SITE QUOTA", "200-Quota for alice:\n Bytes used: 10 of 10\n Files used: 2 of 3\n200 END"},
+		{"MKD d", "257"},
+		{"MKD e", "552"},
+		{"DELE b.txt", "250"},
+		{"AVBL", "213 6"},
+	}
+	for _, tt := range quotaTests {
+		if reply := send(tt.line); !strings.HasPrefix(reply, tt.reply) {
+			t.Errorf("%s: expected reply %q, got %q", tt.line, tt.reply, reply)
+		}
+	}
+
+	// a resumed upload only charges the data past the offset
+	send("REST 2")
+	stor("a.txt", "0123456789", "552")
+	if got := readMemFile(t, driver, "/a.txt", 0); got != "abcd" {
+		t.Errorf("got %q after exceeding the quota", got)
+	}
+	send("REST 2")
+	stor("a.txt", "xy", "226")
+	if reply := send("AVBL"); reply != "213 6" {
+		t.Errorf("AVBL after resuming: got %q", reply)
+	}
+	if usage := store.usage["alice"]; usage != (Usage{Bytes: 4, Files: 2}) {
+		t.Errorf("unexpected usage saved %+v", usage)
+	}
+}
+
+func TestQuotaOnLoginDriver(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	c, replies := newTestConn(memDriver)
+	defer c.Close()
+	c.user = ""
+	c.server = NewServer(&ServerOpts{
+		Logger: &DiscardLogger{},
+		Auth:   &SimpleAuth{Name: "alice", Password: "secret"},
+		Quota: &QuotaManager{
+			Limit: func(user string) Quota {
+				return Quota{MaxBytes: 4}
+			},
+			Store: &memQuotaStore{usage: map[string]Usage{}},
+		},
+		OnLogin: func(conn *Conn) error {
+			// a new driver, not wrapping the one of the session
+			conn.SetDriver(NewDropBoxDriver(AdaptDriver(memDriver)))
+			return nil
+		},
+	})
+
+	for _, line := range []string{"USER alice", "PASS secret"} {
+		done := sendCommand(c, line+"\r\n")
+		readMultiline(t, replies)
+		<-done
+	}
+	for _, tt := range []struct{ name, data, reply string }{
+		{"a.txt", "0123456789", "552"},
+		{"b.txt", "012", "226"},
+	} {
+		client, server := net.Pipe()
+		c.dataConn = pipeSocket{server}
+		done := sendCommand(c, "STOR "+tt.name+"\r\n")
+		expectReply(t, replies, "150")
+		<-done
+		go func() {
+			client.Write([]byte(tt.data))
+			client.Close()
+		}()
+		expectReply(t, replies, tt.reply)
+	}
+	done := sendCommand(c, "AVBL\r\n")
+	if reply := readMultiline(t, replies); reply != "213 1" {
+		t.Errorf("AVBL: got %q", reply)
+	}
+	<-done
+}
+
+func TestQuotaStore(t *testing.T) {
+	store := &memQuotaStore{usage: map[string]Usage{"alice": {Bytes: 7, Files: 1}}}
+	manager := &QuotaManager{
+		Limit: func(user string) Quota { return Quota{} },
+		Store: store,
+	}
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	if _, err := memDriver.PutFile("/a.txt", strings.NewReader("abc"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	for user, expected := range map[string]Usage{"alice": {7, 1}, "bob": {3, 1}} {
+		driver := &quotaDriver{AdaptDriver(memDriver), manager, &Conn{user: user}}
+		usage, _, err := driver.usage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage != expected {
+			t.Errorf("usage of %s: got %+v, want %+v", user, usage, expected)
+		}
+	}
+	if usage := store.usage["bob"]; usage != (Usage{3, 1}) {
+		t.Errorf("computed usage not saved, got %+v", usage)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// NewReadOnlyDriver returns a DriverV2 serving the files of driver, for
+// example a public mirror, refusing every change with ErrPermission. To
+// restrict some users only, replace their driver from ServerOpts.OnLogin:
+//
+//	conn.SetDriver(server.NewReadOnlyDriver(conn.Driver()))
+func NewReadOnlyDriver(driver DriverV2) DriverV2 {
+	return readOnlyDriver{driver}
+}
+
+// readOnlyDriver is the DriverV2 returned by NewReadOnlyDriver. It
+// implements Perm and TimesDriver so that SITE CHMOD and MFMT are refused
+// as well.
+type readOnlyDriver struct {
+	DriverV2
+}
+
+func (driver readOnlyDriver) deny(name string) error {
+	return fmt.Errorf("%s: read-only access: %w", name, ErrPermission)
+}
+
+func (driver readOnlyDriver) DeleteDir(ctx context.Context, name string) error {
+	return driver.deny(name)
+}
+
+func (driver readOnlyDriver) DeleteFile(ctx context.Context, name string) error {
+	return driver.deny(name)
+}
+
+func (driver readOnlyDriver) Rename(ctx context.Context, fromPath string, toPath string) error {
+	return driver.deny(fromPath)
+}
+
+func (driver readOnlyDriver) MakeDir(ctx context.Context, name string) error {
+	return driver.deny(name)
+}
+
+func (driver readOnlyDriver) PutFile(ctx context.Context, name string, data io.Reader, appendData bool) (int64, error) {
+	return 0, driver.deny(name)
+}
+
+func (driver readOnlyDriver) GetOwner(name string) (string, error) {
+	info, err := driver.Stat(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	return info.Owner(), nil
+}
+
+func (driver readOnlyDriver) GetGroup(name string) (string, error) {
+	info, err := driver.Stat(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	return info.Group(), nil
+}
+
+func (driver readOnlyDriver) GetMode(name string) (os.FileMode, error) {
+	info, err := driver.Stat(context.Background(), name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Mode(), nil
+}
+
+func (driver readOnlyDriver) ChOwner(name string, owner string) error {
+	return driver.deny(name)
+}
+
+func (driver readOnlyDriver) ChGroup(name string, group string) error {
+	return driver.deny(name)
+}
+
+func (driver readOnlyDriver) ChMode(name string, mode os.FileMode) error {
+	return driver.deny(name)
+}
+
+func (driver readOnlyDriver) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	return driver.deny(name)
+}
+
+// NewDropBoxDriver returns a DriverV2 letting clients upload files to
+// driver and create directories, but nothing else: directories are listed
+// empty, and downloads and any other change are refused with
+// ErrPermission. Only directories can be examined, so that clients cannot
+// find out which files were uploaded. Like NewReadOnlyDriver it can be
+// selected per user from ServerOpts.OnLogin.
+func NewDropBoxDriver(driver DriverV2) DriverV2 {
+	return dropBoxDriver{driver}
+}
+
+// dropBoxDriver is the DriverV2 returned by NewDropBoxDriver.
+type dropBoxDriver struct {
+	DriverV2
+}
+
+func (driver dropBoxDriver) deny(name string) error {
+	return fmt.Errorf("%s: upload only access: %w", name, ErrPermission)
+}
+
+func (driver dropBoxDriver) Stat(ctx context.Context, name string) (FileInfo, error) {
+	info, err := driver.DriverV2.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, driver.deny(name)
+	}
+	return info, nil
+}
+
+func (driver dropBoxDriver) ListDir(ctx context.Context, name string, callback func(FileInfo) error) error {
+	_, err := driver.Stat(ctx, name)
+	return err
+}
+
+func (driver dropBoxDriver) DeleteDir(ctx context.Context, name string) error {
+	return driver.deny(name)
+}
+
+func (driver dropBoxDriver) DeleteFile(ctx context.Context, name string) error {
+	return driver.deny(name)
+}
+
+func (driver dropBoxDriver) Rename(ctx context.Context, fromPath string, toPath string) error {
+	return driver.deny(fromPath)
+}
+
+func (driver dropBoxDriver) GetFile(ctx context.Context, name string, offset int64) (int64, io.ReadCloser, error) {
+	return 0, nil, driver.deny(name)
+}
+
+func (driver dropBoxDriver) GetOwner(name string) (string, error) {
+	return "", driver.deny(name)
+}
+
+func (driver dropBoxDriver) GetGroup(name string) (string, error) {
+	return "", driver.deny(name)
+}
+
+func (driver dropBoxDriver) GetMode(name string) (os.FileMode, error) {
+	return 0, driver.deny(name)
+}
+
+func (driver dropBoxDriver) ChOwner(name string, owner string) error {
+	return driver.deny(name)
+}
+
+func (driver dropBoxDriver) ChGroup(name string, group string) error {
+	return driver.deny(name)
+}
+
+func (driver dropBoxDriver) ChMode(name string, mode os.FileMode) error {
+	return driver.deny(name)
+}
+
+func (driver dropBoxDriver) SetTimes(name string, atime, mtime, ctime time.Time) error {
+	return driver.deny(name)
+}
+
+// wrapRestricted returns driver wrapped by wrap, below the drivers of
+// NewReadOnlyDriver and NewDropBoxDriver so that the wrapper still sees
+// every file while the restrictions apply to the client.
+func wrapRestricted(driver DriverV2, wrap func(DriverV2) DriverV2) DriverV2 {
+	switch driver := driver.(type) {
+	case readOnlyDriver:
+		return readOnlyDriver{wrapRestricted(driver.DriverV2, wrap)}
+	case dropBoxDriver:
+		return dropBoxDriver{wrapRestricted(driver.DriverV2, wrap)}
+	}
+	return wrap(driver)
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRestrictedDrivers(t *testing.T) {
+	factory := NewMemDriverFactory("ftp", "ftp")
+	driver, _ := factory.NewDriver()
+	driver.Init(&Conn{})
+	if _, err := driver.PutFile("/a.txt", strings.NewReader("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	var restrictTests = []struct {
+		user     string
+		commands []string
+		replies  []string
+	}{
+		{
+			"mirror",
+			[]string{"SIZE a.txt", "DELE a.txt", "MKD dir", "RNFR a.txt", "SITE CHMOD 600 a.txt", "MFMT 20180102030405 a.txt"},
+			[]string{"213", "550", "550", "350", "550", "550"},
+		},
+		{
+			"partner",
+			[]string{"SIZE a.txt", "CWD /", "MKD dir", "DELE a.txt", "MDTM a.txt", "SITE CHMOD 600 a.txt"},
+			[]string{"550", "250", "257", "550", "550", "550"},
+		},
+	}
+	for _, tt := range restrictTests {
+		driver, _ := factory.NewDriver()
+		c, replies := newTestConn(driver)
+		c.user = ""
+		c.server = NewServer(&ServerOpts{
+			Logger: &DiscardLogger{},
+			Auth:   &SimpleAuth{Name: tt.user, Password: "secret"},
+			Perm:   NewSimplePerm("ftp", "ftp"),
+			OnLogin: func(conn *Conn) error {
+				switch conn.LoginUser() {
+				case "mirror":
+					conn.SetDriver(NewReadOnlyDriver(conn.Driver()))
+				case "partner":
+					conn.SetDriver(NewDropBoxDriver(conn.Driver()))
+				}
+				return nil
+			},
+		})
+
+		lines := append([]string{"USER " + tt.user, "PASS secret"}, tt.commands...)
+		codes := append([]string{"331", "230"}, tt.replies...)
+		for i, line := range lines {
+			done := sendCommand(c, line+"\r\n")
+			expectReply(t, replies, codes[i])
+			<-done
+		}
+		c.Close()
+	}
+}
+
+func TestDropBoxDriver(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	driver := NewDropBoxDriver(AdaptDriver(memDriver))
+	ctx := context.Background()
+
+	if _, err := driver.PutFile(ctx, "/a.txt", strings.NewReader("secret"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.MakeDir(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if names := listMemDir(t, memDriver, "/"); names != "a.txt dir" {
+		t.Errorf("got %q in the wrapped driver", names)
+	}
+
+	err := driver.ListDir(ctx, "/", func(f FileInfo) error {
+		t.Errorf("unexpected %s in the listing", f.Name())
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ListDir: %v", err)
+	}
+	if _, err := driver.Stat(ctx, "/dir"); err != nil {
+		t.Errorf("Stat of a directory: %v", err)
+	}
+	if _, _, err := driver.GetFile(ctx, "/a.txt", 0); !errors.Is(err, ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+	if _, err := driver.Stat(ctx, "/a.txt"); !errors.Is(err, ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import "strings"
+
+// sessionState tracks the commands of RFC 959 that must be followed by a
+// specific command: USER by PASS, RNFR by RNTO and REST by a transfer, as
+// well as SITE CPFR by SITE CPTO.
+type sessionState int
+
+const (
+	// stateReady accepts any command but PASS and RNTO
+	stateReady sessionState = iota
+	// stateUser follows USER, PASS is expected
+	stateUser
+	// stateRename follows a successful RNFR, RNTO is expected
+	stateRename
+	// stateRestart follows a successful REST, a transfer is expected
+	stateRestart
+	// stateCopy follows a successful SITE CPFR, SITE CPTO is expected
+	stateCopy
+)
+
+var (
+	// sequenceCommands are only accepted in the given state
+	sequenceCommands = map[string]sessionState{
+		"PASS":      stateUser,
+		"RNTO":      stateRename,
+		"SITE CPTO": stateCopy,
+	}
+
+	// dataCommands need a data connection opened by PORT, PASV or one of
+	// their variants
+	dataCommands = map[string]bool{
+		"APPE": true,
+		"LIST": true,
+		"MLSD": true,
+		"NLST": true,
+		"RETR": true,
+		"STOR": true,
+	}
+
+	// dataSetupCommands may come between REST and the transfer
+	dataSetupCommands = map[string]bool{
+		"EPRT": true,
+		"EPSV": true,
+		"LPRT": true,
+		"PASV": true,
+		"PORT": true,
+	}
+)
+
+// sequenceName returns the name of command in the state machine, which
+// for SITE includes the subcommand, such as "SITE CPTO".
+func sequenceName(command string, param string) string {
+	if command != "SITE" {
+		return command
+	}
+	return command + " " + strings.ToUpper(strings.SplitN(param, " ", 2)[0])
+}
+
+// checkSequence reports whether command may be run in the current state,
+// replying 503 or 425 if not.
+func (conn *Conn) checkSequence(command string) bool {
+	if state, ok := sequenceCommands[command]; ok && conn.state != state {
+		switch command {
+		case "PASS":
+			conn.writeMessage(503, "Login with USER first")
+		default:
+			conn.writeMessage(503, "Bad sequence of commands, "+command+" without previous command")
+		}
+		return false
+	}
+	if dataCommands[command] && conn.dataConn == nil {
+		conn.writeMessage(425, "Use PORT or PASV first")
+		return false
+	}
+	return true
+}
+
+// leaveState moves the session back to stateReady before command runs,
+// dropping the pending USER, RNFR, REST or SITE CPFR unless command
+// consumes it.
+// Commands entering a state set it once they succeed.
+func (conn *Conn) leaveState(command string) {
+	switch conn.state {
+	case stateUser:
+		if command != "PASS" {
+			conn.reqUser = ""
+		}
+	case stateRename:
+		if command != "RNTO" {
+			conn.renameFrom = ""
+		}
+	case stateRestart:
+		if dataSetupCommands[command] {
+			return
+		}
+		if command != "RETR" && command != "STOR" && command != "APPE" {
+			conn.lastFilePos = 0
+			conn.appendData = false
+		}
+	case stateCopy:
+		if command != "SITE CPTO" {
+			conn.copyFrom = ""
+		}
+	}
+	conn.state = stateReady
+}
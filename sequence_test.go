@@ -0,0 +1,118 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// renameDriver records the renames it is asked for.
+type renameDriver struct {
+	Driver
+	renames *[][2]string
+}
+
+func (d renameDriver) Rename(from, to string) error {
+	*d.renames = append(*d.renames, [2]string{from, to})
+	return nil
+}
+
+func TestSequence(t *testing.T) {
+	var renames [][2]string
+	c, replies := newTestConn(renameDriver{renames: &renames})
+	defer c.Close()
+	c.user = ""
+	c.server = NewServer(&ServerOpts{
+		Logger: &DiscardLogger{},
+		Auth:   &SimpleAuth{Name: "admin", Password: "admin"},
+	})
+
+	var sequenceTests = []struct {
+		line  string
+		reply string
+	}{
+		// the login is checked first
+		{"RNTO b", "530"},
+		{"RETR a", "530"},
+
+		// PASS must follow USER
+		{"PASS admin", "503"},
+		{"USER admin", "331"},
+		{"NOOP", "200"},
+		{"PASS admin", "503"},
+		{"USER admin", "331"},
+		{"PASS admin", "230"},
+		{"PASS admin", "503"},
+
+		// RNTO must follow RNFR
+		{"RNTO b", "503"},
+		{"RNFR a", "350"},
+		{"NOOP", "200"},
+		{"RNTO b", "503"},
+		{"RNFR a", "350"},
+		{"RNTO b", "250"},
+		{"RNTO c", "503"},
+
+		// transfers need PORT or PASV
+		{"RETR a", "425"},
+		{"STOR a", "425"},
+		{"APPE a", "425"},
+		{"LIST", "425"},
+		{"NLST", "425"},
+		{"MLSD", "425"},
+
+		// REST is dropped by an unrelated command
+		{"TYPE I", "200"},
+		{"REST 10", "350"},
+		{"NOOP", "200"},
+	}
+	for _, tt := range sequenceTests {
+		done := sendCommand(c, tt.line+"\r\n")
+		expectReply(t, replies, tt.reply)
+		<-done
+	}
+
+	if len(renames) != 1 || renames[0] != [2]string{"/a", "/b"} {
+		t.Errorf("unexpected renames %v", renames)
+	}
+	if c.lastFilePos != 0 || c.appendData {
+		t.Errorf("REST still pending after NOOP: offset %d", c.lastFilePos)
+	}
+
+	// a USER refused until AUTH TLS does not let PASS through
+	c.user = ""
+	c.tlsConfig = &tls.Config{}
+	for _, tt := range []struct{ line, reply string }{
+		{"USER admin", "534"},
+		{"PASS admin", "503"},
+	} {
+		done := sendCommand(c, tt.line+"\r\n")
+		expectReply(t, replies, tt.reply)
+		<-done
+	}
+}
+
+func TestLeaveState(t *testing.T) {
+	var leaveTests = []struct {
+		command string
+		offset  int64
+	}{
+		{"PASV", 10},
+		{"EPSV", 10},
+		{"PORT", 10},
+		{"RETR", 10},
+		{"STOR", 10},
+		{"NOOP", 0},
+		{"SIZE", 0},
+	}
+	for _, tt := range leaveTests {
+		c := &Conn{state: stateRestart, lastFilePos: 10, appendData: true}
+		c.leaveState(tt.command)
+		if c.lastFilePos != tt.offset {
+			t.Errorf("REST then %s: got offset %d, want %d", tt.command, c.lastFilePos, tt.offset)
+		}
+	}
+}
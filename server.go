@@ -6,12 +6,15 @@ package server
 
 import (
 	"bufio"
+	"compress/zlib"
 	"context"
 	"crypto/tls"
 	"errors"
-	"fmt"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 // Version returns the library version
@@ -22,11 +25,30 @@ func Version() string {
 // ServerOpts contains parameters for server.NewServer()
 type ServerOpts struct {
 	// The factory that will be used to create a new FTPDriver instance for
-	// each client connection. This is a mandatory option.
+	// each client connection. This is a mandatory option, unless FactoryV2
+	// is set.
 	Factory DriverFactory
 
+	// The factory of context-aware drivers, used instead of Factory if set.
+	FactoryV2 DriverFactoryV2
+
 	Auth Auth
 
+	// The quotas of the users, enforced on the drivers of their sessions,
+	// including one set by OnLogin, and reported by AVBL and SITE QUOTA.
+	// Optional.
+	Quota *QuotaManager
+
+	// If true uploads are stored under a temporary name hidden from the
+	// listings, and renamed into place only once all the data was
+	// received. Failed or aborted uploads leave no file behind. It also
+	// applies to a driver set by OnLogin.
+	AtomicUploads bool
+
+	// The Perm used by SITE CHMOD, CHOWN and CHGRP. Optional, if nil the
+	// driver is used when it implements Perm itself.
+	Perm Perm
+
 	// Server Name, Default is Go Ftp Server
 	Name string
 
@@ -60,6 +82,29 @@ type ServerOpts struct {
 
 	// A logger implementation, if nil the StdLogger is used
 	Logger Logger
+
+	// Middlewares wrapped around every command, the first one being the
+	// outermost. Optional.
+	Middlewares []Middleware
+
+	// The commands clients may use. Optional, if empty all the registered
+	// commands are allowed. USER, PASS and QUIT are always allowed. Aliases
+	// such as XMKD follow the command they run.
+	AllowedCommands []string
+
+	// The commands clients may not use, they are answered with 502 and not
+	// advertised by FEAT. Optional.
+	DisabledCommands []string
+
+	// OnLogin is called when a user has logged in, before the reply is sent.
+	// It may adjust the session, for example with Conn.AllowCommands or
+	// Conn.DisableCommands. Returning an error refuses the login. Optional.
+	OnLogin func(*Conn) error
+
+	// ErrorMessage returns the text of the reply sent with code when a
+	// driver call failed with err. Optional, by default the text of err is
+	// used, without the local path of an *os.PathError.
+	ErrorMessage func(conn *Conn, code int, err error) string
 }
 
 // Server is the root of your FTP application. You should instantiate one
@@ -70,11 +115,16 @@ type Server struct {
 	*ServerOpts
 	listenTo  string
 	logger    Logger
+	lock      sync.Mutex // protects listener
 	listener  net.Listener
 	tlsConfig *tls.Config
-	ctx       context.Context
+	ctx       context.Context // cancelled by Shutdown
 	cancel    context.CancelFunc
-	feats     string
+	cmdLock   sync.RWMutex // protects commands
+	commands  commandMap
+	dispatch  CommandHandler
+	allowed   map[string]bool
+	disabled  map[string]bool
 }
 
 // ErrServerClosed is returned by ListenAndServe() or Serve() when a shutdown
@@ -99,6 +149,7 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 		newOpts.Port = opts.Port
 	}
 	newOpts.Factory = opts.Factory
+	newOpts.FactoryV2 = opts.FactoryV2
 	if opts.Name == "" {
 		newOpts.Name = "Go FTP Server"
 	} else {
@@ -114,6 +165,9 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 	if opts.Auth != nil {
 		newOpts.Auth = opts.Auth
 	}
+	newOpts.Perm = opts.Perm
+	newOpts.Quota = opts.Quota
+	newOpts.AtomicUploads = opts.AtomicUploads
 
 	newOpts.Logger = &StdLogger{}
 	if opts.Logger != nil {
@@ -127,6 +181,11 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 
 	newOpts.PublicIp = opts.PublicIp
 	newOpts.PassivePorts = opts.PassivePorts
+	newOpts.Middlewares = opts.Middlewares
+	newOpts.AllowedCommands = opts.AllowedCommands
+	newOpts.DisabledCommands = opts.DisabledCommands
+	newOpts.OnLogin = opts.OnLogin
+	newOpts.ErrorMessage = opts.ErrorMessage
 
 	return &newOpts
 }
@@ -154,16 +213,114 @@ func NewServer(opts *ServerOpts) *Server {
 	s.ServerOpts = opts
 	s.listenTo = net.JoinHostPort(opts.Hostname, strconv.Itoa(opts.Port))
 	s.logger = opts.Logger
+	s.commands = make(commandMap, len(commands))
+	for name, cmd := range commands {
+		s.commands[name] = cmd
+	}
+	s.dispatch = chainMiddlewares(executeCommand, opts.Middlewares)
+	s.allowed = commandSet(opts.AllowedCommands)
+	s.disabled = commandSet(opts.DisabledCommands)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s
 }
 
+// commandSet returns the set of the canonical names of the commands, or nil
+// if there are none.
+func commandSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[canonicalCommand(name)] = true
+	}
+	return set
+}
+
+// handler returns the CommandHandler running the commands received by the
+// server, wrapped in its middlewares.
+func (server *Server) handler() CommandHandler {
+	if server.dispatch == nil {
+		return executeCommand
+	}
+	return server.dispatch
+}
+
+// RegisterCommand adds a command to the server, replacing the built-in or
+// previously registered command of the same name. Command names are case
+// insensitive. It should be called before the server starts accepting
+// connections.
+func (server *Server) RegisterCommand(name string, cmd Command) {
+	server.cmdLock.Lock()
+	defer server.cmdLock.Unlock()
+	server.commands[strings.ToUpper(name)] = cmd
+}
+
+// UnregisterCommand removes a command from the server, clients calling it
+// will be told the command is not found.
+func (server *Server) UnregisterCommand(name string) {
+	server.cmdLock.Lock()
+	defer server.cmdLock.Unlock()
+	delete(server.commands, strings.ToUpper(name))
+}
+
+// LookupCommand returns the command registered on the server under name,
+// for example to wrap a built-in command before replacing it.
+func (server *Server) LookupCommand(name string) (Command, bool) {
+	server.cmdLock.RLock()
+	defer server.cmdLock.RUnlock()
+	cmd, ok := server.commandMap()[strings.ToUpper(name)]
+	return cmd, ok
+}
+
+// commandMap returns the commands of the server, the built-in ones if the
+// Server was not created with NewServer. Callers must hold cmdLock.
+func (server *Server) commandMap() commandMap {
+	if server.commands == nil {
+		return commands
+	}
+	return server.commands
+}
+
+// extensions returns the sorted names of the registered commands that are
+// listed by FEAT.
+func (server *Server) extensions() []string {
+	server.cmdLock.RLock()
+	defer server.cmdLock.RUnlock()
+	var names []string
+	for name, cmd := range server.commandMap() {
+		if cmd.IsExtend() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandNames returns the sorted names of the registered commands.
+func (server *Server) commandNames() []string {
+	server.cmdLock.RLock()
+	defer server.cmdLock.RUnlock()
+	var names []string
+	for name := range server.commandMap() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // NewConn constructs a new object that will handle the FTP protocol over
 // an active net.TCPConn. The TCP connection should already be open before
 // it is handed to this functions. driver is an instance of FTPDriver that
 // will handle all auth and persistence details.
-func (server *Server) newConn(tcpConn net.Conn, driver Driver) *Conn {
+func (server *Server) newConn(tcpConn net.Conn, driver DriverV2) *Conn {
 	c := new(Conn)
 	c.namePrefix = "/"
+	// sessions start in binary mode, sending files unchanged until the
+	// client asks for TYPE A
+	c.transferType = "I"
+	c.transferMode = "S"
+	c.zlibLevel = zlib.DefaultCompression
 	c.conn = tcpConn
 	c.controlReader = bufio.NewReader(tcpConn)
 	c.controlWriter = bufio.NewWriter(tcpConn)
@@ -173,6 +330,14 @@ func (server *Server) newConn(tcpConn net.Conn, driver Driver) *Conn {
 	c.sessionID = newSessionID()
 	c.logger = server.logger
 	c.tlsConfig = server.tlsConfig
+	c.mlstFacts = append([]string(nil), supportedMlstFacts...)
+	c.hashAlgo = defaultHashAlgo
+	c.rangeEnd = -1
+	if server.ctx != nil {
+		c.ctx, c.cancel = context.WithCancel(server.ctx)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
 
 	driver.Init(c)
 	return c
@@ -204,7 +369,6 @@ func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 func (server *Server) ListenAndServe() error {
 	var listener net.Listener
 	var err error
-	var curFeats = featCmds
 
 	if server.ServerOpts.TLS {
 		server.tlsConfig, err = simpleTLSConfig(server.CertFile, server.KeyFile)
@@ -212,8 +376,6 @@ func (server *Server) ListenAndServe() error {
 			return err
 		}
 
-		curFeats += " AUTH TLS\n PBSZ\n PROT\n"
-
 		if server.ServerOpts.ExplicitFTPS {
 			listener, err = net.Listen("tcp", server.listenTo)
 		} else {
@@ -225,7 +387,6 @@ func (server *Server) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
-	server.feats = fmt.Sprintf(feats, curFeats)
 
 	sessionID := ""
 	server.logger.Printf(sessionID, "%s listening on %d", server.Name, server.Port)
@@ -237,11 +398,18 @@ func (server *Server) ListenAndServe() error {
 // request in a new goroutine.
 //
 func (server *Server) Serve(l net.Listener) error {
+	server.lock.Lock()
+	if server.ctx.Err() != nil {
+		server.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
 	server.listener = l
-	server.ctx, server.cancel = context.WithCancel(context.Background())
+	server.lock.Unlock()
+
 	sessionID := ""
 	for {
-		tcpConn, err := server.listener.Accept()
+		tcpConn, err := l.Accept()
 		if err != nil {
 			select {
 			case <-server.ctx.Done():
@@ -254,7 +422,7 @@ func (server *Server) Serve(l net.Listener) error {
 			}
 			return err
 		}
-		driver, err := server.Factory.NewDriver()
+		driver, err := server.factory().NewDriverV2()
 		if err != nil {
 			server.logger.Printf(sessionID, "Error creating driver, aborting client connection: %v", err)
 			tcpConn.Close()
@@ -265,11 +433,20 @@ func (server *Server) Serve(l net.Listener) error {
 	}
 }
 
-// Shutdown will gracefully stop a server. Already connected clients will retain their connections
-func (server *Server) Shutdown() error {
-	if server.cancel != nil {
-		server.cancel()
+// factory returns the factory of the drivers of new sessions.
+func (server *Server) factory() DriverFactoryV2 {
+	if server.FactoryV2 != nil {
+		return server.FactoryV2
 	}
+	return driverFactoryAdapter{server.Factory}
+}
+
+// Shutdown will gracefully stop a server. Already connected clients will retain their connections,
+// but the context given to their drivers is cancelled.
+func (server *Server) Shutdown() error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.cancel()
 	if server.listener != nil {
 		return server.listener.Close()
 	}
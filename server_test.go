@@ -7,28 +7,20 @@ package server_test
 import (
 	"io/ioutil"
 	"net"
-	"os"
 	"strings"
 	"testing"
 	"time"
 
-	filedriver "github.com/goftp/file-driver"
 	"github.com/goftp/server"
 	"github.com/jlaffaye/ftp"
 	"github.com/stretchr/testify/assert"
 )
 
-func runServer(t *testing.T, execute func()) {
-	os.MkdirAll("./testdata", os.ModePerm)
-
-	var perm = server.NewSimplePerm("test", "test")
+func runServer(t *testing.T, execute func(addr string, factory *server.MemDriverFactory)) {
+	factory := server.NewMemDriverFactory("test", "test")
 	opt := &server.ServerOpts{
-		Name: "test ftpd",
-		Factory: &filedriver.FileDriverFactory{
-			RootPath: "./testdata",
-			Perm:     perm,
-		},
-		Port: 2121,
+		Name:    "test ftpd",
+		Factory: factory,
 		Auth: &server.SimpleAuth{
 			Name:     "admin",
 			Password: "admin",
@@ -36,23 +28,26 @@ func runServer(t *testing.T, execute func()) {
 		Logger: new(server.DiscardLogger),
 	}
 
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
 	s := server.NewServer(opt)
 	go func() {
-		err := s.ListenAndServe()
+		err := s.Serve(l)
 		assert.EqualError(t, err, server.ErrServerClosed.Error())
 	}()
 
-	execute()
+	execute(l.Addr().String(), factory)
 
 	assert.NoError(t, s.Shutdown())
 }
 
 func TestConnect(t *testing.T) {
-	runServer(t, func() {
+	runServer(t, func(addr string, factory *server.MemDriverFactory) {
 		// Give server 0.5 seconds to get to the listening state
 		timeout := time.NewTimer(time.Millisecond * 500)
 		for {
-			f, err := ftp.Connect("localhost:2121")
+			f, err := ftp.Connect(addr)
 			if err != nil && len(timeout.C) == 0 { // Retry errors
 				continue
 			}
@@ -69,7 +64,11 @@ func TestConnect(t *testing.T) {
 			assert.EqualValues(t, 1, len(names))
 			assert.EqualValues(t, "server_test.go", names[0])
 
-			bs, err := ioutil.ReadFile("./testdata/server_test.go")
+			driver, err := factory.NewDriver()
+			assert.NoError(t, err)
+			_, data, err := driver.GetFile("/server_test.go", 0)
+			assert.NoError(t, err)
+			bs, err := ioutil.ReadAll(data)
 			assert.NoError(t, err)
 			assert.EqualValues(t, content, string(bs))
 
@@ -118,17 +117,10 @@ func TestConnect(t *testing.T) {
 }
 
 func TestServe(t *testing.T) {
-	os.MkdirAll("./testdata", os.ModePerm)
-
-	var perm = server.NewSimplePerm("test", "test")
-
 	// Server options without hostname or port
 	opt := &server.ServerOpts{
-		Name: "test ftpd",
-		Factory: &filedriver.FileDriverFactory{
-			RootPath: "./testdata",
-			Perm:     perm,
-		},
+		Name:    "test ftpd",
+		Factory: server.NewMemDriverFactory("test", "test"),
 		Auth: &server.SimpleAuth{
 			Name:     "admin",
 			Password: "admin",
@@ -137,7 +129,7 @@ func TestServe(t *testing.T) {
 	}
 
 	// Start the listener
-	l, err := net.Listen("tcp", ":2121")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	assert.NoError(t, err)
 
 	// Start the server using the listener
@@ -150,7 +142,7 @@ func TestServe(t *testing.T) {
 	// Give server 0.5 seconds to get to the listening state
 	timeout := time.NewTimer(time.Millisecond * 500)
 	for {
-		f, err := ftp.Connect("localhost:2121")
+		f, err := ftp.Connect(l.Addr().String())
 		if err != nil && len(timeout.C) == 0 { // Retry errors
 			continue
 		}
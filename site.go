@@ -0,0 +1,487 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	siteCommands = commandMap{
+		"CHGRP":    siteChgrp{},
+		"CHMOD":    siteChmod{},
+		"CHOWN":    siteChown{},
+		"CPFR":     siteCpfr{},
+		"CPTO":     siteCpto{},
+		"HELP":     siteHelp{},
+		"QUOTA":    siteQuota{},
+		"READLINK": siteReadlink{},
+		"SYMLINK":  siteSymlink{},
+		"UTIME":    siteUtime{},
+	}
+)
+
+// siteOptional is implemented by the SITE subcommands relying on the
+// driver or the server options. They are only offered when available
+// reports true, and answered with 502 otherwise.
+type siteOptional interface {
+	available(conn *Conn) bool
+}
+
+// siteAvailable reports whether cmd may be used in the session.
+func siteAvailable(conn *Conn, cmd Command) bool {
+	opt, ok := cmd.(siteOptional)
+	return !ok || opt.available(conn)
+}
+
+// commandSite responds to the SITE FTP command. The first word of the
+// parameter names a subcommand, which is looked up in siteCommands and
+// handed the rest of the parameter.
+type commandSite struct{}
+
+func (cmd commandSite) IsExtend() bool {
+	return false
+}
+
+func (cmd commandSite) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSite) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandSite) Execute(conn *Conn, param string) {
+	parts := strings.SplitN(param, " ", 2)
+	var args string
+	if len(parts) == 2 {
+		args = strings.TrimSpace(parts[1])
+	}
+
+	cmdObj := siteCommands[strings.ToUpper(parts[0])]
+	if cmdObj == nil {
+		conn.writeMessage(500, "Unknown SITE command")
+		return
+	}
+	if !siteAvailable(conn, cmdObj) {
+		conn.writeMessage(502, "Command not implemented")
+	} else if cmdObj.RequireParam() && args == "" {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+	} else if cmdObj.RequireAuth() && conn.user == "" {
+		conn.writeMessage(530, "not logged in")
+	} else {
+		cmdObj.Execute(conn, args)
+	}
+}
+
+// splitSiteArgs splits the arguments of a SITE subcommand taking a value
+// and a path, such as "SITE CHMOD 755 file".
+func splitSiteArgs(args string) (string, string, bool) {
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return "", "", false
+	}
+	return parts[0], strings.TrimSpace(parts[1]), true
+}
+
+// siteChmod responds to SITE CHMOD, which changes the mode of a file using
+// an octal mode such as 644.
+type siteChmod struct{}
+
+func (cmd siteChmod) IsExtend() bool {
+	return false
+}
+
+func (cmd siteChmod) RequireParam() bool {
+	return true
+}
+
+func (cmd siteChmod) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteChmod) available(conn *Conn) bool {
+	return conn.perm() != nil
+}
+
+func (cmd siteChmod) Execute(conn *Conn, param string) {
+	perm := conn.perm()
+	if perm == nil {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+	value, name, ok := splitSiteArgs(param)
+	if !ok {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 07777 {
+		conn.writeMessage(501, "Invalid mode "+value)
+		return
+	}
+
+	// the special bits have their own flags in os.FileMode
+	fileMode := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+
+	err = perm.ChMode(conn.buildPath(name), fileMode)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(200, "SITE CHMOD command successful")
+}
+
+// siteChown responds to SITE CHOWN, which changes the owner of a file.
+type siteChown struct{}
+
+func (cmd siteChown) IsExtend() bool {
+	return false
+}
+
+func (cmd siteChown) RequireParam() bool {
+	return true
+}
+
+func (cmd siteChown) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteChown) available(conn *Conn) bool {
+	return conn.perm() != nil
+}
+
+func (cmd siteChown) Execute(conn *Conn, param string) {
+	perm := conn.perm()
+	if perm == nil {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+	owner, name, ok := splitSiteArgs(param)
+	if !ok {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+
+	err := perm.ChOwner(conn.buildPath(name), owner)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(200, "SITE CHOWN command successful")
+}
+
+// siteChgrp responds to SITE CHGRP, which changes the group of a file.
+type siteChgrp struct{}
+
+func (cmd siteChgrp) IsExtend() bool {
+	return false
+}
+
+func (cmd siteChgrp) RequireParam() bool {
+	return true
+}
+
+func (cmd siteChgrp) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteChgrp) available(conn *Conn) bool {
+	return conn.perm() != nil
+}
+
+func (cmd siteChgrp) Execute(conn *Conn, param string) {
+	perm := conn.perm()
+	if perm == nil {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+	group, name, ok := splitSiteArgs(param)
+	if !ok {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+
+	err := perm.ChGroup(conn.buildPath(name), group)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(200, "SITE CHGRP command successful")
+}
+
+// siteHelp responds to SITE HELP by listing the known SITE subcommands
+// with their syntax, or describing the one given as parameter.
+type siteHelp struct{}
+
+func (cmd siteHelp) IsExtend() bool {
+	return false
+}
+
+func (cmd siteHelp) RequireParam() bool {
+	return false
+}
+
+func (cmd siteHelp) RequireAuth() bool {
+	return false
+}
+
+func (cmd siteHelp) Execute(conn *Conn, param string) {
+	if fields := strings.Fields(param); len(fields) > 0 {
+		name := strings.ToUpper(fields[0])
+		subCmd, ok := siteCommands[name]
+		if !ok {
+			conn.writeMessage(502, "Unknown SITE command "+name)
+			return
+		}
+		conn.writeMessage(214, "Syntax: "+commandSyntax(name, subCmd, siteSyntaxes))
+		return
+	}
+
+	var names []string
+	for name, subCmd := range siteCommands {
+		if siteAvailable(conn, subCmd) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, commandSyntax(name, siteCommands[name], siteSyntaxes))
+	}
+	conn.writeMessageMultiline(214, "The following SITE commands are recognized:\n "+strings.Join(lines, "\n ")+"\n")
+}
+
+// siteUtime responds to SITE UTIME. Both the two argument form
+//
+//	SITE UTIME YYYYMMDDhhmm[ss] path
+//
+// and the five argument form
+//
+//	SITE UTIME path YYYYMMDDhhmmss YYYYMMDDhhmmss YYYYMMDDhhmmss UTC
+//
+// giving the access, modification and creation times are accepted.
+type siteUtime struct{}
+
+func (cmd siteUtime) IsExtend() bool {
+	return false
+}
+
+func (cmd siteUtime) RequireParam() bool {
+	return true
+}
+
+func (cmd siteUtime) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteUtime) available(conn *Conn) bool {
+	return implements(conn.driver, "", isTimesDriver)
+}
+
+func (cmd siteUtime) Execute(conn *Conn, param string) {
+	driver, ok := unwrapDriver(conn.driver).(TimesDriver)
+	if !ok || !implements(conn.driver, "", isTimesDriver) {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+
+	var name string
+	var atime, mtime, ctime time.Time
+	var err error
+	fields := strings.Fields(param)
+	if len(fields) >= 5 && strings.ToUpper(fields[len(fields)-1]) == "UTC" {
+		times := fields[len(fields)-4 : len(fields)-1]
+		if atime, err = parseTimeVal(times[0]); err == nil {
+			if mtime, err = parseTimeVal(times[1]); err == nil {
+				ctime, err = parseTimeVal(times[2])
+			}
+		}
+		name = trimLastFields(param, fields, 4)
+	} else if len(fields) >= 2 {
+		mtime, err = parseTimeVal(fields[0])
+		atime = mtime
+		name = strings.TrimSpace(strings.TrimPrefix(param, fields[0]))
+	} else {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	if err != nil {
+		conn.writeMessage(501, "Invalid time value")
+		return
+	}
+
+	// like other servers, ignore a creation time that cannot be set
+	if !creationTimeSupported(conn.driver) {
+		ctime = time.Time{}
+	}
+	err = driver.SetTimes(conn.buildPath(name), atime, mtime, ctime)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(200, "SITE UTIME command successful")
+}
+
+// siteSymlink responds to SITE SYMLINK, which creates a symbolic link to
+// target. The target is given to the driver as is.
+type siteSymlink struct{}
+
+func (cmd siteSymlink) IsExtend() bool {
+	return false
+}
+
+func (cmd siteSymlink) RequireParam() bool {
+	return true
+}
+
+func (cmd siteSymlink) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteSymlink) available(conn *Conn) bool {
+	_, ok := unwrapDriver(conn.driver).(SymlinkDriver)
+	return ok
+}
+
+func (cmd siteSymlink) Execute(conn *Conn, param string) {
+	target, name, ok := splitSiteArgs(param)
+	if !ok {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	driver := unwrapDriver(conn.driver).(SymlinkDriver)
+	name = conn.buildPath(name)
+	err := conn.accounted(name, 0, func() error {
+		return driver.Symlink(target, name)
+	})
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(200, "SITE SYMLINK command successful")
+}
+
+// siteReadlink responds to SITE READLINK with the target of a symbolic
+// link.
+type siteReadlink struct{}
+
+func (cmd siteReadlink) IsExtend() bool {
+	return false
+}
+
+func (cmd siteReadlink) RequireParam() bool {
+	return true
+}
+
+func (cmd siteReadlink) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteReadlink) available(conn *Conn) bool {
+	_, ok := unwrapDriver(conn.driver).(SymlinkDriver)
+	return ok
+}
+
+func (cmd siteReadlink) Execute(conn *Conn, param string) {
+	driver := unwrapDriver(conn.driver).(SymlinkDriver)
+	target, err := driver.Readlink(conn.buildPath(param))
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(200, target)
+}
+
+// siteCpfr responds to SITE CPFR, the first of the two commands copying a
+// file on the server. The source is remembered for SITE CPTO.
+type siteCpfr struct{}
+
+func (cmd siteCpfr) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCpfr) RequireParam() bool {
+	return true
+}
+
+func (cmd siteCpfr) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCpfr) available(conn *Conn) bool {
+	_, ok := unwrapDriver(conn.driver).(CopyDriver)
+	return ok
+}
+
+func (cmd siteCpfr) Execute(conn *Conn, param string) {
+	name := conn.buildPath(param)
+	info, err := conn.driver.Stat(conn.Context(), name)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	if info.IsDir() {
+		conn.writeMessage(550, "Only files can be copied")
+		return
+	}
+	conn.copyFrom = name
+	conn.state = stateCopy
+	conn.writeMessage(350, "File exists, ready for destination name")
+}
+
+// siteCpto responds to SITE CPTO by copying the file given to SITE CPFR.
+type siteCpto struct{}
+
+func (cmd siteCpto) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCpto) RequireParam() bool {
+	return true
+}
+
+func (cmd siteCpto) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCpto) available(conn *Conn) bool {
+	_, ok := unwrapDriver(conn.driver).(CopyDriver)
+	return ok
+}
+
+func (cmd siteCpto) Execute(conn *Conn, param string) {
+	from := conn.copyFrom
+	conn.copyFrom = ""
+	info, err := conn.driver.Stat(conn.Context(), from)
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+
+	driver := unwrapDriver(conn.driver).(CopyDriver)
+	to := conn.buildPath(param)
+	err = conn.accounted(to, info.Size(), func() error {
+		return driver.CopyFile(from, to)
+	})
+	if err != nil {
+		conn.replyError(550, err)
+		return
+	}
+	conn.writeMessage(250, "Copy successful")
+}
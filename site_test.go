@@ -0,0 +1,81 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+type recordingPerm struct {
+	SimplePerm
+	calls []string
+}
+
+func (p *recordingPerm) ChOwner(name, owner string) error {
+	p.calls = append(p.calls, "chown "+owner+" "+name)
+	return nil
+}
+
+func (p *recordingPerm) ChGroup(name, group string) error {
+	p.calls = append(p.calls, "chgrp "+group+" "+name)
+	return nil
+}
+
+func (p *recordingPerm) ChMode(name string, mode os.FileMode) error {
+	p.calls = append(p.calls, "chmod "+mode.String()+" "+name)
+	return nil
+}
+
+func TestSiteCommands(t *testing.T) {
+	perm := &recordingPerm{}
+	var buf bytes.Buffer
+	c := &Conn{
+		namePrefix:    "/",
+		user:          "admin",
+		controlWriter: bufio.NewWriter(&buf),
+		logger:        &DiscardLogger{},
+		server: &Server{
+			ServerOpts: &ServerOpts{Perm: perm},
+		},
+	}
+
+	var siteTests = []struct {
+		param string
+		reply string
+	}{
+		{"CHMOD 644 a file.txt", "200 "},
+		{"chown bob /dir/b.txt", "200 "},
+		{"CHGRP staff b.txt", "200 "},
+		{"CHMOD 4755 b.txt", "200 "},
+		{"CHMOD 3700 b.txt", "200 "},
+		{"CHMOD 999 b.txt", "501 "},
+		{"CHMOD 644", "501 "},
+		{"CHOWN", "501 "},
+		{"NOPE x", "500 "},
+		{"HELP", "214-"},
+	}
+	for _, tt := range siteTests {
+		buf.Reset()
+		commandSite{}.Execute(c, tt.param)
+		if !strings.HasPrefix(buf.String(), tt.reply) {
+			t.Errorf("SITE %s: expected reply %q, got %q", tt.param, tt.reply, buf.String())
+		}
+	}
+
+	expected := []string{
+		"chmod -rw-r--r-- /a file.txt",
+		"chown bob /dir/b.txt",
+		"chgrp staff /b.txt",
+		"chmod urwxr-xr-x /b.txt",
+		"chmod gtrwx------ /b.txt",
+	}
+	if strings.Join(perm.calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected calls %v, got %v", expected, perm.calls)
+	}
+}
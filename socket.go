@@ -103,8 +103,11 @@ type ftpPassiveSocket struct {
 	ingress   chan []byte
 	egress    chan []byte
 	logger    Logger
-	lock      sync.Mutex // protects conn and err
+	lock      sync.Mutex // protects conn, listener, err and closed
+	listener  net.Listener
+	ready     chan struct{} // closed once the client connected or failed to
 	err       error
+	closed    bool
 	tlsConfig *tls.Config
 }
 
@@ -138,6 +141,7 @@ func newPassiveSocket(host string, port func() int, logger Logger, sessionID str
 	socket := new(ftpPassiveSocket)
 	socket.ingress = make(chan []byte)
 	socket.egress = make(chan []byte)
+	socket.ready = make(chan struct{})
 	socket.logger = logger
 	socket.host = host
 	socket.tlsConfig = tlsConfig
@@ -163,42 +167,54 @@ func (socket *ftpPassiveSocket) Port() int {
 	return socket.port
 }
 
-func (socket *ftpPassiveSocket) Read(p []byte) (n int, err error) {
+// waitConn waits for the client to connect to the passive socket. It does
+// not hold the lock while the connection is used, so that Close can
+// interrupt a blocked Read or Write.
+func (socket *ftpPassiveSocket) waitConn() (net.Conn, error) {
+	<-socket.ready
 	socket.lock.Lock()
 	defer socket.lock.Unlock()
-	if socket.err != nil {
-		return 0, socket.err
+	return socket.conn, socket.err
+}
+
+func (socket *ftpPassiveSocket) Read(p []byte) (n int, err error) {
+	conn, err := socket.waitConn()
+	if err != nil {
+		return 0, err
 	}
-	return socket.conn.Read(p)
+	return conn.Read(p)
 }
 
 func (socket *ftpPassiveSocket) ReadFrom(r io.Reader) (int64, error) {
-	socket.lock.Lock()
-	defer socket.lock.Unlock()
-	if socket.err != nil {
-		return 0, socket.err
+	conn, err := socket.waitConn()
+	if err != nil {
+		return 0, err
 	}
 
 	// For normal TCPConn, this will use sendfile syscall; if not,
 	// it will just downgrade to normal read/write procedure
-	return io.Copy(socket.conn, r)
+	return io.Copy(conn, r)
 }
 
 func (socket *ftpPassiveSocket) Write(p []byte) (n int, err error) {
-	socket.lock.Lock()
-	defer socket.lock.Unlock()
-	if socket.err != nil {
-		return 0, socket.err
+	conn, err := socket.waitConn()
+	if err != nil {
+		return 0, err
 	}
-	return socket.conn.Write(p)
+	return conn.Write(p)
 }
 
 func (socket *ftpPassiveSocket) Close() error {
 	socket.lock.Lock()
 	defer socket.lock.Unlock()
+	socket.closed = true
 	if socket.conn != nil {
 		return socket.conn.Close()
 	}
+	if socket.listener != nil {
+		// the client has not connected yet, stop waiting for it
+		return socket.listener.Close()
+	}
 	return nil
 }
 
@@ -240,17 +256,27 @@ func (socket *ftpPassiveSocket) GoListenAndServe(sessionID string) (err error) {
 	}
 
 	socket.lock.Lock()
+	socket.listener = listener
+	socket.lock.Unlock()
 	go func() {
-		defer socket.lock.Unlock()
+		defer close(socket.ready)
 
 		conn, err := listener.Accept()
+		_ = listener.Close()
+
+		socket.lock.Lock()
+		defer socket.lock.Unlock()
+		socket.listener = nil
+		if err == nil && socket.closed {
+			conn.Close()
+			err = net.ErrClosed
+		}
 		if err != nil {
 			socket.err = err
 			return
 		}
 		socket.err = nil
 		socket.conn = conn
-		_ = listener.Close()
 	}()
 	return nil
 }
@@ -0,0 +1,181 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var errNoDataConn = errors.New("no data connection")
+
+// transfer is a data transfer running in the background while the control
+// connection keeps reading commands, so that the client can ABOR it or ask
+// for its STAT.
+type transfer struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	socket  DataSocket
+	bytes   int64 // accessed atomically
+	stopped int32 // accessed atomically
+	done    chan struct{}
+
+	// MODE Z state, the data on the socket is a zlib stream
+	compress bool
+	level    int
+	zr       io.ReadCloser
+	zw       *zlib.Writer
+}
+
+// Read reads from the data socket, failing once the transfer is aborted.
+func (t *transfer) Read(p []byte) (n int, err error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if t.socket == nil {
+		return 0, errNoDataConn
+	}
+	if t.compress {
+		if t.zr == nil {
+			if t.zr, err = zlib.NewReader(t.socket); err != nil {
+				return 0, err
+			}
+		}
+		n, err = t.zr.Read(p)
+	} else {
+		n, err = t.socket.Read(p)
+	}
+	atomic.AddInt64(&t.bytes, int64(n))
+	return n, err
+}
+
+// Write writes to the data socket, failing once the transfer is aborted.
+func (t *transfer) Write(p []byte) (n int, err error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if t.socket == nil {
+		return 0, errNoDataConn
+	}
+	if t.compress {
+		if err = t.startCompression(); err != nil {
+			return 0, err
+		}
+		n, err = t.zw.Write(p)
+	} else {
+		n, err = t.socket.Write(p)
+	}
+	atomic.AddInt64(&t.bytes, int64(n))
+	return n, err
+}
+
+func (t *transfer) startCompression() (err error) {
+	if t.zw == nil {
+		t.zw, err = zlib.NewWriterLevel(t.socket, t.level)
+	}
+	return err
+}
+
+// close closes the data socket. It must be called once the data has been
+// received, before the final reply.
+func (t *transfer) close() error {
+	if t.socket == nil {
+		return nil
+	}
+	return t.socket.Close()
+}
+
+// closeWrite terminates the data sent to the client and closes the data
+// socket. It must be called once the data has been sent, before the final
+// reply.
+func (t *transfer) closeWrite() error {
+	if t.socket == nil {
+		return nil
+	}
+	var err error
+	if t.compress && !t.aborted() {
+		// an empty transfer still needs a complete zlib stream
+		if err = t.startCompression(); err == nil {
+			err = t.zw.Close()
+		}
+	}
+	if cerr := t.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Bytes returns the number of bytes transferred so far.
+func (t *transfer) Bytes() int64 {
+	return atomic.LoadInt64(&t.bytes)
+}
+
+// abort cancels the transfer and closes its data socket, which unblocks any
+// read or write in progress.
+func (t *transfer) abort() {
+	atomic.StoreInt32(&t.stopped, 1)
+	t.cancel()
+	if t.socket != nil {
+		t.socket.Close()
+	}
+}
+
+// aborted reports whether abort was called.
+func (t *transfer) aborted() bool {
+	return atomic.LoadInt32(&t.stopped) == 1
+}
+
+// startTransfer hands the current data socket over to a new transfer and
+// runs fn in the background. fn is responsible for sending the final reply
+// of the transfer command, which must be 426 if the transfer was aborted.
+func (conn *Conn) startTransfer(fn func(t *transfer)) {
+	ctx, cancel := context.WithCancel(conn.Context())
+	t := &transfer{
+		ctx:    ctx,
+		cancel: cancel,
+		socket: conn.dataConn,
+		done:   make(chan struct{}),
+
+		compress: conn.transferMode == "Z",
+		level:    conn.zlibLevel,
+	}
+	conn.dataConn = nil
+
+	conn.lock.Lock()
+	conn.transfer = t
+	conn.lock.Unlock()
+
+	go func() {
+		defer func() {
+			if t.socket != nil {
+				t.socket.Close()
+			}
+			cancel()
+
+			conn.lock.Lock()
+			conn.transfer = nil
+			conn.lock.Unlock()
+			close(t.done)
+		}()
+		fn(t)
+	}()
+}
+
+// currentTransfer returns the transfer in progress, if any.
+func (conn *Conn) currentTransfer() *transfer {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.transfer
+}
+
+// waitTransfer blocks until the transfer in progress, if any, is finished.
+func (conn *Conn) waitTransfer() {
+	if t := conn.currentTransfer(); t != nil {
+		<-t.done
+	}
+}
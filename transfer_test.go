@@ -0,0 +1,343 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeSocket is a DataSocket over one end of a net.Pipe.
+type pipeSocket struct {
+	net.Conn
+}
+
+func (s pipeSocket) Host() string { return "pipe" }
+func (s pipeSocket) Port() int    { return 0 }
+func (s pipeSocket) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(s.Conn, r)
+}
+
+// endlessDriver serves and accepts files of infinite length, so that
+// transfers only end when they are aborted.
+type endlessDriver struct {
+	Driver
+}
+
+func (d endlessDriver) Init(conn *Conn) {}
+
+func (d endlessDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	return -1, ioutil.NopCloser(zeroReader{}), nil
+}
+
+func (d endlessDriver) PutFile(path string, data io.Reader, appendData bool) (int64, error) {
+	return io.Copy(ioutil.Discard, data)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func newTestConn(driver Driver) (*Conn, *bufio.Reader) {
+	client, server := net.Pipe()
+	c := &Conn{
+		conn:          server,
+		controlWriter: bufio.NewWriter(server),
+		driver:        AdaptDriver(driver),
+		logger:        &DiscardLogger{},
+		namePrefix:    "/",
+		user:          "admin",
+		server: &Server{
+			ServerOpts: &ServerOpts{Name: "test ftpd"},
+		},
+	}
+	return c, bufio.NewReader(client)
+}
+
+// sendCommand runs line in the background like Conn.Serve would. The
+// returned channel is closed once the command returned.
+func sendCommand(c *Conn, line string) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.receiveLine(line)
+	}()
+	return done
+}
+
+func expectReply(t *testing.T, r *bufio.Reader, code string) {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected %s reply, got error %v", code, err)
+	}
+	if !strings.HasPrefix(strings.TrimRight(line, "\r\n")+" ", code+" ") {
+		t.Fatalf("expected %s reply, got %q", code, line)
+	}
+}
+
+func TestAbortTransfer(t *testing.T) {
+	for _, command := range []string{"STOR", "RETR"} {
+		t.Run(command, func(t *testing.T) {
+			c, replies := newTestConn(endlessDriver{})
+			defer c.Close()
+
+			client, server := net.Pipe()
+			defer client.Close()
+			c.dataConn = pipeSocket{server}
+			if command == "STOR" {
+				go io.Copy(client, zeroReader{})
+			} else {
+				go io.Copy(ioutil.Discard, client)
+			}
+
+			done := sendCommand(c, command+" file\r\n")
+			expectReply(t, replies, "150")
+			<-done
+
+			deadline := time.Now().Add(5 * time.Second)
+			for c.currentTransfer() == nil || c.currentTransfer().Bytes() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("transfer did not start")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			sendCommand(c, "\xff\xf4\xff\xf2ABOR\r\n")
+			expectReply(t, replies, "426")
+			expectReply(t, replies, "226")
+			if c.currentTransfer() != nil {
+				t.Error("expected no transfer in progress after ABOR")
+			}
+		})
+	}
+}
+
+func TestAbortWithoutTransfer(t *testing.T) {
+	c, replies := newTestConn(endlessDriver{})
+	defer c.Close()
+
+	sendCommand(c, "ABOR\r\n")
+	expectReply(t, replies, "225")
+}
+
+// bufferDriver serves and stores a single in-memory file.
+type bufferDriver struct {
+	Driver
+	data *bytes.Buffer
+}
+
+func (d bufferDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	return int64(d.data.Len()), ioutil.NopCloser(bytes.NewReader(d.data.Bytes())), nil
+}
+
+func (d bufferDriver) PutFile(path string, data io.Reader, appendData bool) (int64, error) {
+	d.data.Reset()
+	return io.Copy(d.data, data)
+}
+
+func TestModeZ(t *testing.T) {
+	content := bytes.Repeat([]byte("compress me\r\n"), 1000)
+	driver := bufferDriver{data: bytes.NewBuffer(content)}
+	c, replies := newTestConn(driver)
+	defer c.Close()
+	c.zlibLevel = zlib.BestCompression
+
+	done := sendCommand(c, "MODE Z\r\n")
+	expectReply(t, replies, "200")
+	<-done
+
+	// RETR sends a zlib stream
+	client, server := net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "RETR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	var received bytes.Buffer
+	zr, err := zlib.NewReader(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(&received, zr); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, replies, "226")
+	if !bytes.Equal(received.Bytes(), content) {
+		t.Errorf("RETR in MODE Z: got %d bytes, want %d", received.Len(), len(content))
+	}
+
+	// STOR receives one
+	client, server = net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "STOR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	zw := zlib.NewWriter(client)
+	zw.Write([]byte("uploaded"))
+	zw.Close()
+	client.Close()
+	expectReply(t, replies, "226")
+	if driver.data.String() != "uploaded" {
+		t.Errorf("STOR in MODE Z: got %q", driver.data.String())
+	}
+}
+
+func TestTypeA(t *testing.T) {
+	driver := bufferDriver{data: bytes.NewBufferString("one\ntwo\n")}
+	c, replies := newTestConn(driver)
+	defer c.Close()
+
+	done := sendCommand(c, "TYPE A\r\n")
+	expectReply(t, replies, "200")
+	<-done
+
+	client, server := net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "RETR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	received, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, replies, "226")
+	if string(received) != "one\r\ntwo\r\n" {
+		t.Errorf("RETR in TYPE A: got %q", received)
+	}
+
+	client, server = net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "STOR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	client.Write([]byte("three\r\nfour\r\n"))
+	client.Close()
+	expectReply(t, replies, "226")
+	if driver.data.String() != "three\nfour\n" {
+		t.Errorf("STOR in TYPE A: got %q", driver.data.String())
+	}
+
+	done = sendCommand(c, "SIZE file\r\n")
+	expectReply(t, replies, "550")
+	<-done
+	done = sendCommand(c, "REST 10\r\n")
+	expectReply(t, replies, "504")
+	<-done
+}
+
+func TestDefaultType(t *testing.T) {
+	s := NewServer(&ServerOpts{Logger: &DiscardLogger{}})
+	driver := newMemDriver(t)
+	driver.Init(&Conn{})
+	if _, err := driver.PutFile("/file", strings.NewReader("one\ntwo\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	c := s.newConn(server, AdaptDriver(driver))
+	defer c.Close()
+	c.user = "admin"
+	replies := bufio.NewReader(client)
+
+	done := sendCommand(c, "SIZE file\r\n")
+	expectReply(t, replies, "213")
+	<-done
+	done = sendCommand(c, "REST 4\r\n")
+	expectReply(t, replies, "350")
+	<-done
+}
+
+func TestResumeUpload(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	c, replies := newTestConn(partialDriver{memDriver})
+	defer c.Close()
+
+	// the first upload is interrupted after 5 bytes
+	client, server := net.Pipe()
+	defer client.Close()
+	c.dataConn = pipeSocket{server}
+	done := sendCommand(c, "STOR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	client.Write([]byte("01234"))
+	sendCommand(c, "ABOR\r\n")
+	expectReply(t, replies, "426")
+	expectReply(t, replies, "226")
+
+	var resumeTests = []struct {
+		offset  string
+		data    string
+		content string
+	}{
+		{"5", "56789", "0123456789"},
+		{"3", "abc", "012abc"},
+		{"0", "new", "new"},
+	}
+	for _, tt := range resumeTests {
+		done = sendCommand(c, "REST "+tt.offset+"\r\n")
+		expectReply(t, replies, "350")
+		<-done
+
+		client, server = net.Pipe()
+		c.dataConn = pipeSocket{server}
+		done = sendCommand(c, "STOR file\r\n")
+		expectReply(t, replies, "150")
+		<-done
+		client.Write([]byte(tt.data))
+		client.Close()
+		expectReply(t, replies, "226")
+		if got := readMemFile(t, memDriver, "/file", 0); got != tt.content {
+			t.Errorf("REST %s: got %q, want %q", tt.offset, got, tt.content)
+		}
+	}
+}
+
+func TestResumeUploadAppend(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	if _, err := memDriver.PutFile("/file", strings.NewReader("0123"), false); err != nil {
+		t.Fatal(err)
+	}
+	// hides the RestartDriver of memDriver
+	c, replies := newTestConn(struct{ Driver }{memDriver})
+	defer c.Close()
+
+	// uploads can then only be resumed at the end of the file
+	done := sendCommand(c, "REST 2\r\n")
+	expectReply(t, replies, "350")
+	<-done
+	c.dataConn = pipeSocket{}
+	done = sendCommand(c, "STOR file\r\n")
+	expectReply(t, replies, "554")
+	<-done
+
+	done = sendCommand(c, "REST 4\r\n")
+	expectReply(t, replies, "350")
+	<-done
+	client, server := net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done = sendCommand(c, "STOR file\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	client.Write([]byte("4567"))
+	client.Close()
+	expectReply(t, replies, "226")
+	if got := readMemFile(t, memDriver, "/file", 0); got != "01234567" {
+		t.Errorf("got %q after appending", got)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+)
+
+// uploadPrefix starts the names of the temporary files of atomic uploads.
+const uploadPrefix = ".upload."
+
+// atomicDriver is the DriverV2 of the sessions when
+// ServerOpts.AtomicUploads is set. Files are stored under a hidden
+// temporary name in the same directory, then renamed into place once all
+// the data was received, so that nobody sees a partial file at the final
+// name. Appends are written in place.
+type atomicDriver struct {
+	DriverV2
+}
+
+// uploadName returns a new temporary name for an upload to name.
+func uploadName(name string) string {
+	return path.Join(path.Dir(name), uploadPrefix+newSessionID()[:8]+"."+path.Base(name))
+}
+
+// ListDir hides the temporary files of the uploads in progress.
+func (driver atomicDriver) ListDir(ctx context.Context, name string, callback func(FileInfo) error) error {
+	return driver.DriverV2.ListDir(ctx, name, func(f FileInfo) error {
+		if strings.HasPrefix(f.Name(), uploadPrefix) {
+			return nil
+		}
+		return callback(f)
+	})
+}
+
+// PutFile stores data in a temporary file renamed to name on success. The
+// temporary file is deleted if the transfer failed or was aborted.
+func (driver atomicDriver) PutFile(ctx context.Context, name string, data io.Reader, appendData bool) (int64, error) {
+	if appendData {
+		return driver.DriverV2.PutFile(ctx, name, data, appendData)
+	}
+
+	tmpName := uploadName(name)
+	bytes, err := driver.DriverV2.PutFile(ctx, tmpName, data, false)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = driver.DriverV2.Rename(ctx, tmpName, name)
+	}
+	if err != nil {
+		// ctx may be cancelled already
+		driver.DriverV2.DeleteFile(context.Background(), tmpName)
+		return bytes, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// partialDriver keeps the data received before an upload failed, like
+// most drivers writing to a file do.
+type partialDriver struct {
+	*MemDriver
+}
+
+func (d partialDriver) PutFile(path string, data io.Reader, appendData bool) (int64, error) {
+	received, err := ioutil.ReadAll(data)
+	if _, err := d.MemDriver.PutFile(path, bytes.NewReader(received), appendData); err != nil {
+		return 0, err
+	}
+	return int64(len(received)), err
+}
+
+func TestAtomicUploads(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	driver := atomicDriver{AdaptDriver(partialDriver{memDriver})}
+	ctx := context.Background()
+
+	if _, err := driver.PutFile(ctx, "/a.txt", strings.NewReader("old"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	broken := iotest.TimeoutReader(strings.NewReader("new data"))
+	if _, err := driver.PutFile(ctx, "/a.txt", iotest.OneByteReader(broken), false); !errors.Is(err, iotest.ErrTimeout) {
+		t.Errorf("expected the read error, got %v", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := driver.PutFile(cancelled, "/b.txt", strings.NewReader("b"), false); err == nil {
+		t.Error("expected an aborted upload to fail")
+	}
+
+	if names := listMemDir(t, memDriver, "/"); names != "a.txt" {
+		t.Errorf("got %q, expected the temporary files to be removed", names)
+	}
+	if got := readMemFile(t, memDriver, "/a.txt", 0); got != "old" {
+		t.Errorf("got %q after a failed upload", got)
+	}
+
+	// a partial file is never listed
+	if _, err := memDriver.PutFile("/"+uploadPrefix+"x.c.txt", strings.NewReader("c"), false); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err := driver.ListDir(ctx, "/", func(f FileInfo) error {
+		names = append(names, f.Name())
+		return nil
+	})
+	if err != nil || strings.Join(names, " ") != "a.txt" {
+		t.Errorf("ListDir: got %v, %v", names, err)
+	}
+}
+
+// namingDriver records the names of the files stored.
+type namingDriver struct {
+	*MemDriver
+	names *[]string
+}
+
+func (d namingDriver) PutFile(path string, data io.Reader, appendData bool) (int64, error) {
+	*d.names = append(*d.names, path)
+	return d.MemDriver.PutFile(path, data, appendData)
+}
+
+func TestAtomicUploadsOnLoginDriver(t *testing.T) {
+	memDriver := newMemDriver(t)
+	memDriver.Init(&Conn{})
+	var names []string
+	c, replies := newTestConn(memDriver)
+	defer c.Close()
+	c.user = ""
+	c.server = NewServer(&ServerOpts{
+		Logger:        &DiscardLogger{},
+		Auth:          &SimpleAuth{Name: "alice", Password: "secret"},
+		AtomicUploads: true,
+		OnLogin: func(conn *Conn) error {
+			conn.SetDriver(NewDropBoxDriver(AdaptDriver(namingDriver{memDriver, &names})))
+			return nil
+		},
+	})
+
+	for _, line := range []string{"USER alice", "PASS secret"} {
+		done := sendCommand(c, line+"\r\n")
+		readMultiline(t, replies)
+		<-done
+	}
+	client, server := net.Pipe()
+	c.dataConn = pipeSocket{server}
+	done := sendCommand(c, "STOR a.txt\r\n")
+	expectReply(t, replies, "150")
+	<-done
+	client.Write([]byte("hello"))
+	client.Close()
+	expectReply(t, replies, "226")
+
+	if len(names) != 1 || !strings.HasPrefix(names[0], "/"+uploadPrefix) {
+		t.Errorf("expected an upload to a temporary file, got %v", names)
+	}
+	if got := readMemFile(t, memDriver, "/a.txt", 0); got != "hello" {
+		t.Errorf("got %q after the upload", got)
+	}
+}